@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/validator"
+)
+
+const (
+	// Batches get a larger body limit than readJSON() allows for a single movie, and
+	// a cap on the number of items so one request can't hold a transaction open for
+	// too long.
+	batchMaxBytes = 10 * 1_048_576
+	batchMaxItems = 1000
+)
+
+// batchResult reports what happened to a single item in a batch, identified by its
+// position in the request body.
+type batchResult struct {
+	Index      int                    `json:"index"`
+	Status     string                 `json:"status"`
+	Movie      *data.Movie            `json:"movie,omitempty"`
+	Errors     map[string]string      `json:"errors,omitempty"`
+	Duplicates []*data.MovieDuplicate `json:"duplicates,omitempty"`
+}
+
+func (app *application) createMoviesBatchHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	// In atomic mode the batch is saved in a single transaction and rejected as a
+	// whole if any item is invalid. In best_effort mode every valid item is saved on
+	// its own and the rest are reported back. Likely duplicates of existing movies
+	// count as failed items, unless the client confirms them all with ?force=true.
+	mode := app.readString(r.URL.Query(), "mode", "atomic")
+	force := app.readBool(r.URL.Query(), "force", false, v)
+
+	if v.Check(validator.PermittedValue(mode, "atomic", "best_effort"), "mode", "must be either atomic or best_effort"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	items, err := app.readBatch(w, r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	movies := make([]*data.Movie, len(items))
+	results := make([]batchResult, len(items))
+	invalid, duplicate := 0, 0
+
+	// Decode every item first, so that the genres of the whole batch can be resolved
+	// to their canonical names with a single query.
+	var genres []string
+
+	for i, item := range items {
+		results[i].Index = i
+
+		movie, err := decodeBatchMovie(item)
+		if err != nil {
+			results[i].Status = "invalid"
+			results[i].Errors = map[string]string{"json": err.Error()}
+			invalid++
+			continue
+		}
+
+		movies[i] = movie
+		genres = append(genres, movie.Genres...)
+	}
+
+	canonical, err := app.models.Genres.CanonicalNames(genres)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Items are checked against each other as well as against the database, so that a
+	// batch listing the same film twice doesn't save it twice.
+	accepted := data.NewDuplicateSet()
+
+	for i, movie := range movies {
+		if movie == nil {
+			continue
+		}
+
+		v := validator.New()
+		movie.Genres = data.CanonicalizeGenres(v, movie.Genres, canonical)
+
+		if data.ValidateMovie(v, movie); !v.Valid() {
+			movies[i] = nil
+			results[i].Status = "invalid"
+			results[i].Errors = v.Errors
+			invalid++
+			continue
+		}
+
+		if force {
+			continue
+		}
+
+		duplicates, err := app.findDuplicateMovies(movie)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if len(duplicates) > 0 {
+			movies[i] = nil
+			results[i].Status = "duplicate"
+			results[i].Errors = map[string]string{"movie": "looks like a duplicate of an existing one, resend the batch with ?force=true to save it anyway"}
+			results[i].Duplicates = duplicates
+			duplicate++
+			continue
+		}
+
+		if earlier, ok := accepted.Add(i, movie); ok {
+			movies[i] = nil
+			results[i].Status = "duplicate"
+			results[i].Errors = map[string]string{"movie": fmt.Sprintf("looks like a duplicate of item %d in this batch, resend the batch with ?force=true to save it anyway", earlier)}
+			duplicate++
+		}
+	}
+
+	user := app.contextGetUser(r)
+
+	if mode == "atomic" {
+		if invalid > 0 || duplicate > 0 {
+			for i := range results {
+				if results[i].Status == "" {
+					results[i].Status = "skipped"
+				}
+			}
+
+			// As for a single movie, a batch which is only held back by duplicates
+			// gets a 409 Conflict rather than a 422.
+			status := http.StatusUnprocessableEntity
+			if invalid == 0 {
+				status = http.StatusConflict
+			}
+
+			app.errorResponse(w, r, status, results)
+			return
+		}
+
+		if err := app.models.Movies.InsertBatch(movies, user.ID); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		for i, movie := range movies {
+			results[i].Status = "created"
+			results[i].Movie = movie
+		}
+
+		if err := app.writeJSON(w, http.StatusCreated, map[string]interface{}{"results": results}, nil); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	for i, movie := range movies {
+		if movie == nil {
+			continue
+		}
+
+		if err := app.models.Movies.Insert(movie, user.ID); err != nil {
+			app.logError(r, err)
+			results[i].Status = "failed"
+			results[i].Errors = map[string]string{"movie": "the server could not save this movie"}
+			continue
+		}
+
+		results[i].Status = "created"
+		results[i].Movie = movie
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]interface{}{"results": results}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readBatch splits the request body into its individual JSON items without decoding
+// them, so that a problem with one item can be reported against its index. The body
+// is either a JSON array or, with a Content-Type of application/x-ndjson, a stream of
+// newline-delimited JSON values.
+func (app *application) readBatch(w http.ResponseWriter, r *http.Request) ([]json.RawMessage, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, batchMaxBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := mediaType == "application/x-ndjson"
+
+	decoder := json.NewDecoder(r.Body)
+
+	if !ndjson {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, jsonDecodeError(err)
+		}
+
+		if token != json.Delim('[') {
+			return nil, errors.New("body must contain a JSON array of movies")
+		}
+	}
+
+	var items []json.RawMessage
+
+	for decoder.More() {
+		if len(items) == batchMaxItems {
+			return nil, fmt.Errorf("body must not contain more than %d movies", batchMaxItems)
+		}
+
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, jsonDecodeError(err)
+		}
+
+		items = append(items, item)
+	}
+
+	if !ndjson {
+		if _, err := decoder.Token(); err != nil {
+			return nil, jsonDecodeError(err)
+		}
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		if ndjson {
+			return nil, errors.New("body contains badly-formed JSON after the last movie")
+		}
+
+		return nil, errors.New("body must only contain a single JSON array")
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("body must contain at least one movie")
+	}
+
+	return items, nil
+}
+
+// decodeBatchMovie decodes a single batch item into a movie, returning an error
+// suitable for the client if it isn't well-formed.
+func decodeBatchMovie(item json.RawMessage) (*data.Movie, error) {
+	var input struct {
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(item))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&input); err != nil {
+		return nil, jsonDecodeError(err)
+	}
+
+	movie := &data.Movie{
+		Title:   input.Title,
+		Year:    input.Year,
+		Runtime: input.Runtime,
+		Genres:  input.Genres,
+	}
+
+	return movie, nil
+}
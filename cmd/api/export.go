@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/validator"
+)
+
+// exportMoviesHandler streams every movie matching the same search and sort parameters
+// as listMoviesHandler, as either CSV or newline-delimited JSON. Rows are written out
+// as they're read from the database, so memory use doesn't grow with the export size.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	search, filters := app.readMovieListInput(qs, v)
+	format := app.readString(qs, "format", "csv")
+
+	v.Check(validator.PermittedValue(format, "csv", "ndjson"), "format", "must be either csv or ndjson")
+	data.ValidateMovieSearch(v, search)
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// An export can easily outlast the server's WriteTimeout, so lift the deadline for
+	// this response. The export still stops if the client goes away, because the
+	// query runs under the request context.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var (
+		contentType string
+		header      func() error
+		write       func(*data.Movie) error
+		flush       func() error
+		started     bool
+	)
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		contentType = "text/csv; charset=utf-8"
+		header = func() error {
+			return cw.Write([]string{"id", "title", "year", "runtime", "genres", "version"})
+		}
+		write = func(movie *data.Movie) error {
+			return cw.Write([]string{
+				strconv.FormatInt(movie.ID, 10),
+				movie.Title,
+				strconv.Itoa(int(movie.Year)),
+				strconv.Itoa(int(movie.Runtime)),
+				strings.Join(movie.Genres, "|"),
+				strconv.Itoa(int(movie.Version)),
+			})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case "ndjson":
+		encoder := json.NewEncoder(w)
+		contentType = "application/x-ndjson"
+		header = func() error { return nil }
+		write = func(movie *data.Movie) error { return encoder.Encode(movie) }
+		flush = func() error { return nil }
+	}
+
+	// The headers are only sent once the first row arrives (or the query finishes
+	// with no rows), so that a failing query can still get a proper error response.
+	start := func() error {
+		started = true
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="movies.%s"`, format))
+		w.WriteHeader(http.StatusOK)
+
+		return header()
+	}
+
+	err := app.models.Movies.Export(r.Context(), search, filters, func(movie *data.Movie) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		return write(movie)
+	})
+
+	if err == nil && !started {
+		err = start()
+	}
+
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		if !started {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Once the body has started there's no way to report the failure to the
+		// client beyond cutting the response short, so just log it.
+		app.logError(r, err)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/jandiralceu/greenlight/internal/data"
 )
 
 func (app *application) logError(r *http.Request, err error) {
@@ -46,6 +48,19 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, "unable to update the record due to an edit conflict, please try again")
 }
 
+func (app *application) idempotencyConflictResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusConflict, "a request with this idempotency key is still being processed, please try again later")
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	app.errorResponse(w, r, http.StatusPreconditionFailed, "the record has been modified since you last retrieved it, please fetch it again")
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request) {
+	message := fmt.Sprintf("the %s content type is not supported for this resource", r.Header.Get("Content-Type"))
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	app.errorResponse(w, r, http.StatusTooManyRequests, "rate limit exceeded")
 }
@@ -70,3 +85,15 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	app.errorResponse(w, r, http.StatusForbidden, "your user account doesn't have the necessary permissions to access this resource")
 }
+
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, duplicates []*data.MovieDuplicate) {
+	response := map[string]interface{}{
+		"message":    "this movie looks like a duplicate of an existing one, resend the request with ?force=true to save it anyway",
+		"duplicates": duplicates,
+	}
+
+	if err := app.writeJSON(w, http.StatusConflict, response, nil); err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
@@ -1,22 +1,32 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/jandiralceu/greenlight/internal/data"
 	"github.com/jandiralceu/greenlight/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
 
+// readIDParam reads the id parameter from the route, whether it was matched by the
+// router or by the ServeMux in front of it.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
-	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	value := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if value == "" {
+		value = r.PathValue("id")
+	}
+
+	id, err := strconv.ParseInt(value, 10, 64)
 
 	if err != nil || id < 0 {
 		return 0, errors.New("invalid id parameter")
@@ -52,35 +62,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, destina
 	decoder.DisallowUnknownFields()
 
 	if err := decoder.Decode(destination); err != nil {
-		var (
-			syntaxError           *json.SyntaxError
-			unmarshalTypeError    *json.UnmarshalTypeError
-			invalidUnmarshalError *json.InvalidUnmarshalError
-			maxBytesError         *http.MaxBytesError
-		)
-
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown field %s", fieldName)
-		case errors.As(err, &maxBytesError):
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
-		default:
-			return err
-		}
+		return jsonDecodeError(err)
 	}
 
 	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
@@ -90,6 +72,64 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, destina
 	return nil
 }
 
+// etagMatches reports whether an ETag matches the value of an If-Match or If-None-Match
+// request header, which may be "*" or a comma-separated list of entity tags. If-Match
+// uses the strong comparison, so weak tags never match it, whereas If-None-Match uses
+// the weak comparison and ignores the W/ prefix.
+func etagMatches(header, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+
+		if candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonDecodeError translates an error returned by json.Decoder.Decode() into a message
+// which is safe and useful to send back to the client.
+func jsonDecodeError(err error) error {
+	var (
+		syntaxError           *json.SyntaxError
+		unmarshalTypeError    *json.UnmarshalTypeError
+		invalidUnmarshalError *json.InvalidUnmarshalError
+		maxBytesError         *http.MaxBytesError
+	)
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+		}
+		return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+	case errors.Is(err, io.EOF):
+		return errors.New("body must not be empty")
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return fmt.Errorf("body contains unknown field %s", fieldName)
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	case errors.As(err, &invalidUnmarshalError):
+		panic(err)
+	default:
+		return err
+	}
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -146,6 +186,54 @@ func (app *application) readInt(qs url.Values, key string, defaultValues int, v
 	return i
 }
 
+// The readBool() helper reads a boolean value from the query string, accepting the
+// same spellings as strconv.ParseBool(). If no matching key could be found it returns
+// the provided default value, and an unparsable value is recorded in the Validator.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+
+	return b
+}
+
+// The readRuntime() helper reads a movie runtime in the "<runtime> mins" format from
+// the query string. If no matching key could be found it returns the provided default
+// value, and an unparsable value is recorded in the Validator.
+func (app *application) readRuntime(qs url.Values, key string, defaultValue data.Runtime, v *validator.Validator) data.Runtime {
+	s := qs.Get(key)
+
+	if s == "" {
+		return defaultValue
+	}
+
+	runtime, err := data.ParseRuntime(s)
+	if err != nil {
+		v.AddError(key, `must be in the format "<runtime> mins"`)
+		return defaultValue
+	}
+
+	return runtime
+}
+
+// clientIP returns the IP address the request came from.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
 
@@ -161,3 +249,69 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// readLocales returns the locales the client would like titles in, most preferred
+// first, along with the ones they fall back to. A ?lang= query string parameter takes
+// precedence over the Accept-Language header. An invalid lang parameter is recorded in
+// the Validator, but a malformed header is ignored, as browsers send it unasked.
+func (app *application) readLocales(r *http.Request, v *validator.Validator) []string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		lang = strings.ToLower(lang)
+
+		if !validator.Matches(lang, data.LocaleRX) {
+			v.AddError("lang", "must be a valid language tag")
+			return nil
+		}
+
+		return data.LocaleFallbacks([]string{lang})
+	}
+
+	return data.LocaleFallbacks(parseAcceptLanguage(r.Header.Get("Accept-Language")))
+}
+
+// parseAcceptLanguage returns the language tags in an Accept-Language header, such as
+// "fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5", ordered by their quality values. Tags with a
+// quality of zero, and the "*" wildcard, are left out.
+func parseAcceptLanguage(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+
+	var languages []language
+
+	for _, item := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		tag = strings.TrimSpace(tag)
+
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		if quality <= 0 {
+			continue
+		}
+
+		languages = append(languages, language{tag: tag, quality: quality})
+	}
+
+	slices.SortStableFunc(languages, func(a, b language) int {
+		return cmp.Compare(b.quality, a.quality)
+	})
+
+	tags := make([]string, len(languages))
+	for i, language := range languages {
+		tags[i] = language.tag
+	}
+
+	return tags
+}
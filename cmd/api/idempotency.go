@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+)
+
+// idempotent makes a POST handler safe to retry. When a request carries an
+// Idempotency-Key header, the first response for that key is stored for the configured
+// TTL and replayed, without running the handler again, for any repeat with the same
+// body. Reusing the key with a different body is an error, as is repeating a request
+// while the first one is still being processed. Server errors aren't stored, so that
+// the client can retry them for real.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			app.badRequestResponse(w, r, errors.New("Idempotency-Key header must not be more than 255 bytes long"))
+			return
+		}
+
+		// Read the body up front, so that it can be hashed, and then put it back for
+		// the handler. It's capped at the same size as readJSON allows.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestResponse(w, r, jsonDecodeError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the endpoint and the user, so that clients only have to
+		// keep them unique for themselves. Anonymous callers, such as someone
+		// registering, are told apart by their IP address instead, so that they can't
+		// collide with or replay each other's responses.
+		client := fmt.Sprintf("user:%d", app.contextGetUser(r).ID)
+		if app.contextGetUser(r).IsAnonymous() {
+			client = "ip:" + clientIP(r)
+		}
+
+		record := &data.IdempotencyRecord{
+			Scope:       fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, client),
+			Key:         key,
+			RequestHash: app.idempotencyMAC("request", body),
+			ExpiresAt:   time.Now().Add(app.config.idempotency.ttl),
+		}
+
+		// Request bodies can hold passwords and responses can hold authentication
+		// tokens, so neither is stored as it is. The request is only kept as a keyed
+		// hash, and the response is encrypted with a key which can't be derived
+		// without both the secret and the original request body.
+		responseKey := app.idempotencyMAC("response", body)
+
+		existing, reserved, err := app.models.Idempotency.Reserve(record)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.idempotencyConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		if !reserved {
+			switch {
+			case !bytes.Equal(existing.RequestHash, record.RequestHash):
+				app.failedValidationResponse(w, r, map[string]string{"idempotency_key": "has already been used for a different request"})
+			case existing.Status == 0:
+				app.idempotencyConflictResponse(w, r)
+			default:
+				response, err := openResponse(responseKey, existing.Body)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+
+				for name, values := range existing.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				w.Write(response)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// If the handler panics, give the key up before recoverPanic sends its 500.
+		defer func() {
+			if err := recover(); err != nil {
+				app.releaseIdempotencyKey(record)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status >= http.StatusInternalServerError {
+			app.releaseIdempotencyKey(record)
+			return
+		}
+
+		record.Status = recorder.status
+		record.Header = recorder.Header().Clone()
+
+		record.Body, err = sealResponse(responseKey, recorder.body.Bytes())
+		if err == nil {
+			err = app.models.Idempotency.Complete(record)
+		}
+
+		if err != nil {
+			app.logger.Error(err.Error(), "idempotency_key", key)
+			app.releaseIdempotencyKey(record)
+		}
+	}
+}
+
+// idempotencyMAC returns the HMAC-SHA256 of a request body, keyed with the idempotency
+// secret. The label keeps the MACs used for different purposes apart.
+func (app *application) idempotencyMAC(label string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(app.config.idempotency.secret))
+	mac.Write([]byte(label))
+	mac.Write([]byte{0})
+	mac.Write(body)
+
+	return mac.Sum(nil)
+}
+
+// sealResponse encrypts a response body with AES-256-GCM, prefixing it with the nonce.
+func sealResponse(key, plaintext []byte) ([]byte, error) {
+	aead, err := newResponseCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// openResponse decrypts a response body sealed by sealResponse.
+func openResponse(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newResponseCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("stored idempotent response is too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func newResponseCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (app *application) releaseIdempotencyKey(record *data.IdempotencyRecord) {
+	if err := app.models.Idempotency.Release(record.Scope, record.Key); err != nil {
+		app.logger.Error(err.Error(), "idempotency_key", record.Key)
+	}
+}
+
+// purgeExpiredIdempotencyKeys periodically removes stored responses which have
+// outlived their TTL.
+func (app *application) purgeExpiredIdempotencyKeys() {
+	go func() {
+		for {
+			count, err := app.models.Idempotency.DeleteExpired()
+			if err != nil {
+				app.logger.Error(err.Error())
+			} else if count > 0 {
+				app.logger.Info("purged expired idempotency keys", "count", count)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// responseRecorder passes a response through to the client while keeping a copy of
+// its status code and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status = status
+		rr.wroteHeader = true
+	}
+
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+
+	return rr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/images"
+	"github.com/jandiralceu/greenlight/internal/validator"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (app *application) uploadMovieImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	if _, err := app.models.Movies.Get(id); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	kind, content, err := app.readImageUpload(w, r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(validator.PermittedValue(kind, "poster", "still"), "kind", "must be either poster or still")
+
+	img, contentType, err := images.Decode(content)
+	if err != nil {
+		switch {
+		case errors.Is(err, images.ErrUnsupportedFormat):
+			v.AddError("image", "must be a JPEG, PNG or GIF image")
+		case errors.Is(err, images.ErrTooManyPixels):
+			v.AddError("image", fmt.Sprintf("must not have more than %d pixels", images.MaxPixels))
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	image := &data.MovieImage{
+		MovieID:     id,
+		Kind:        kind,
+		ContentType: contentType,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}
+
+	// The files are written while the database row is still uncommitted. If any of
+	// them fails we remove the ones already written, and the row is rolled back.
+	err = app.models.Images.Insert(image, func(image *data.MovieImage) error {
+		files := map[string][]byte{image.Key(): content}
+
+		for _, thumbnail := range images.Thumbnails {
+			b, err := images.EncodeThumbnail(img, thumbnail)
+			if err != nil {
+				return err
+			}
+			files[image.ThumbnailKey(thumbnail.Name)] = b
+		}
+
+		for key, b := range files {
+			if err := app.storage.Put(r.Context(), key, bytes.NewReader(b)); err != nil {
+				app.deleteImageFiles(image)
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setImageURLs(image)
+
+	headers := make(http.Header)
+	headers.Set("Location", image.URL)
+
+	if err := app.writeJSON(w, http.StatusCreated, image, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteMovieImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	imageID, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("image_id"), 10, 64)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	image, err := app.models.Images.Get(id, imageID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.models.Images.Delete(image); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.deleteImageFiles(image)
+
+	if err := app.writeJSON(w, http.StatusOK, nil, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readImageUpload reads a multipart/form-data upload with an "image" file part and an
+// optional "kind" field, which defaults to "poster". The upload is read into memory,
+// so it's capped at the configured maximum image size rather than readJSON's 1MB.
+func (app *application) readImageUpload(w http.ResponseWriter, r *http.Request) (string, []byte, error) {
+	maxSize := app.config.images.maxSize
+
+	// Leave a little room for the multipart headers and the kind field, on top of
+	// the image itself.
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64*1024)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return "", nil, errors.New("body must be multipart/form-data")
+	}
+
+	kind := "poster"
+	var content []byte
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, uploadError(err)
+		}
+
+		switch part.FormName() {
+		case "kind":
+			b, err := io.ReadAll(io.LimitReader(part, 64))
+			if err != nil {
+				return "", nil, uploadError(err)
+			}
+			kind = strings.TrimSpace(string(b))
+		case "image":
+			if content != nil {
+				return "", nil, errors.New("body must only contain a single image")
+			}
+
+			content, err = io.ReadAll(io.LimitReader(part, maxSize+1))
+			if err != nil {
+				return "", nil, uploadError(err)
+			}
+
+			if int64(len(content)) > maxSize {
+				return "", nil, fmt.Errorf("image must not be larger than %d bytes", maxSize)
+			}
+		default:
+			return "", nil, fmt.Errorf("body contains unknown field %q", part.FormName())
+		}
+	}
+
+	if len(content) == 0 {
+		return "", nil, errors.New("body must contain an image")
+	}
+
+	return kind, content, nil
+}
+
+func uploadError(err error) error {
+	var maxBytesError *http.MaxBytesError
+
+	if errors.As(err, &maxBytesError) {
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+	}
+
+	return errors.New("body contains badly-formed multipart data")
+}
+
+// attachImages loads the images for the given movies in one go and adds them, with
+// their URLs, to each movie.
+func (app *application) attachImages(movies ...*data.Movie) error {
+	ids := make([]int64, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+
+	all, err := app.models.Images.GetAllForMovies(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		movie.Images = all[movie.ID]
+
+		for _, image := range movie.Images {
+			app.setImageURLs(image)
+		}
+	}
+
+	return nil
+}
+
+func (app *application) setImageURLs(image *data.MovieImage) {
+	image.URL = app.storage.URL(image.Key())
+
+	image.Thumbnails = make(map[string]string, len(images.Thumbnails))
+	for _, thumbnail := range images.Thumbnails {
+		image.Thumbnails[thumbnail.Name] = app.storage.URL(image.ThumbnailKey(thumbnail.Name))
+	}
+}
+
+// deleteImageFiles removes an image and its thumbnails from storage. It runs after
+// the database row is gone, so failures are only logged: a stray file is harmless.
+func (app *application) deleteImageFiles(movieImages ...*data.MovieImage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, image := range movieImages {
+		keys := []string{image.Key()}
+		for _, thumbnail := range images.Thumbnails {
+			keys = append(keys, image.ThumbnailKey(thumbnail.Name))
+		}
+
+		for _, key := range keys {
+			if err := app.storage.Delete(ctx, key); err != nil {
+				app.logger.Error(err.Error(), "key", key)
+			}
+		}
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"expvar"
 	"flag"
 	"log/slog"
@@ -12,7 +14,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/jandiralceu/greenlight/internal/jwt"
 	"github.com/jandiralceu/greenlight/internal/mailer"
+	"github.com/jandiralceu/greenlight/internal/storage"
 
 	"github.com/jandiralceu/greenlight/internal/data"
 	_ "github.com/lib/pq"
@@ -31,9 +35,11 @@ type config struct {
 		maxIdleTime  time.Duration
 	}
 	limiter struct {
-		rps     float64
-		burst   int
-		enabled bool
+		rps          float64
+		burst        int
+		suggestRPS   float64
+		suggestBurst int
+		enabled      bool
 	}
 	smtp struct {
 		host     string
@@ -45,14 +51,39 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	trash struct {
+		retention time.Duration
+	}
+	storage struct {
+		dir string
+		url string
+	}
+	images struct {
+		maxSize int64
+	}
+	idempotency struct {
+		ttl    time.Duration
+		secret string
+	}
+	tokens struct {
+		accessTTL      time.Duration
+		refreshTTL     time.Duration
+		mode           string
+		signingKeys    []string
+		revocationSync time.Duration
+	}
 }
 
 type application struct {
-	config config
-	logger *slog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *slog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	storage storage.Storage
+	// signer and revocations are only set when authentication tokens are signed.
+	signer      *jwt.KeySet
+	revocations *revocationList
+	wg          sync.WaitGroup
 }
 
 func main() {
@@ -69,6 +100,8 @@ func main() {
 
 	flag.Float64Var(&cfc.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfc.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.Float64Var(&cfc.limiter.suggestRPS, "limiter-suggest-rps", 10, "Rate limiter maximum title suggestion requests per second")
+	flag.IntVar(&cfc.limiter.suggestBurst, "limiter-suggest-burst", 20, "Rate limiter maximum title suggestion burst")
 	flag.BoolVar(&cfc.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 
 	flag.StringVar(&cfc.smtp.host, "smtp-host", os.Getenv("SMTP_HOST"), "SMTP host")
@@ -82,6 +115,27 @@ func main() {
 		return nil
 	})
 
+	flag.DurationVar(&cfc.trash.retention, "trash-retention", 30*24*time.Hour, "How long deleted movies are kept before being purged (0 keeps them forever)")
+
+	flag.StringVar(&cfc.storage.dir, "storage-dir", "./uploads", "Directory uploaded images are stored in")
+	flag.StringVar(&cfc.storage.url, "storage-url", "/v1/images", "Base URL uploaded images are served from; a path is served by the API itself")
+	flag.Int64Var(&cfc.images.maxSize, "images-max-size", 10*1_048_576, "Maximum size of an uploaded image in bytes")
+
+	flag.DurationVar(&cfc.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are kept for replay")
+	flag.StringVar(&cfc.idempotency.secret, "idempotency-secret", os.Getenv("IDEMPOTENCY_SECRET"), "Secret used to hash requests and encrypt responses stored for idempotency keys")
+
+	flag.DurationVar(&cfc.tokens.accessTTL, "tokens-access-ttl", 15*time.Minute, "How long authentication tokens are valid for")
+	flag.DurationVar(&cfc.tokens.refreshTTL, "tokens-refresh-ttl", 30*24*time.Hour, "How long refresh tokens are valid for")
+	flag.StringVar(&cfc.tokens.mode, "tokens-mode", "opaque", "Kind of authentication tokens to issue (opaque|signed)")
+
+	cfc.tokens.signingKeys = strings.Fields(os.Getenv("TOKENS_SIGNING_KEYS"))
+	flag.Func("tokens-signing-keys", "Keys signed tokens are signed with, as <id>:<EdDSA|HS256>:<base64 key> (space separated, the first one signs)", func(val string) error {
+		cfc.tokens.signingKeys = strings.Fields(val)
+		return nil
+	})
+
+	flag.DurationVar(&cfc.tokens.revocationSync, "tokens-revocation-sync", 5*time.Second, "How often revoked signed tokens are picked up from the database")
+
 	flag.Parse()
 
 	// Initialize a new structured logger which writes log entries to the standard out stream.
@@ -104,6 +158,52 @@ func main() {
 	// established.
 	logger.Info("database connection pool established")
 
+	// Without a configured secret we make one up, which works, but means stored
+	// responses can't be replayed after a restart or by another instance.
+	if cfc.idempotency.secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		cfc.idempotency.secret = hex.EncodeToString(secret)
+		logger.Warn("no idempotency secret configured, using a random one")
+	}
+
+	var signer *jwt.KeySet
+
+	switch cfc.tokens.mode {
+	case "opaque":
+	case "signed":
+		keys := make([]*jwt.Key, 0, len(cfc.tokens.signingKeys))
+
+		for _, spec := range cfc.tokens.signingKeys {
+			key, err := jwt.ParseKey(spec)
+			if err != nil {
+				logger.Error(err.Error())
+				os.Exit(1)
+			}
+
+			keys = append(keys, key)
+		}
+
+		signer, err = jwt.NewKeySet(keys...)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	default:
+		logger.Error("tokens mode must be opaque or signed", "mode", cfc.tokens.mode)
+		os.Exit(1)
+	}
+
+	store, err := storage.NewLocal(cfc.storage.dir, cfc.storage.url)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	expvar.NewString("version").Set(version)
 
 	expvar.Publish("goroutines", expvar.Func(func() any {
@@ -120,10 +220,34 @@ func main() {
 
 	// Declare an instance of the application struct, containing the config struct and the logger.
 	app := &application{
-		config: cfc,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfc.smtp.host, cfc.smtp.port, cfc.smtp.username, cfc.smtp.password, cfc.smtp.sender),
+		config:  cfc,
+		logger:  logger,
+		models:  data.NewModels(db),
+		mailer:  mailer.New(cfc.smtp.host, cfc.smtp.port, cfc.smtp.username, cfc.smtp.password, cfc.smtp.sender),
+		storage: store,
+		signer:  signer,
+	}
+
+	// Start purging movies which have outstayed the trash retention window.
+	app.purgeExpiredMovies()
+
+	// Start removing stored responses for idempotency keys once they expire.
+	app.purgeExpiredIdempotencyKeys()
+
+	// Start removing revoked tokens once they would have expired anyway.
+	app.purgeExpiredRevocations()
+
+	// Signed tokens are checked against a copy of the revocation list kept in memory,
+	// which has to be loaded before the first request comes in.
+	if app.signer != nil {
+		app.revocations = newRevocationList()
+
+		if err := app.syncRevocations(); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		app.watchRevocations()
 	}
 
 	// Call app.serve() to start the server.
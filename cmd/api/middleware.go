@@ -27,33 +27,72 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-func (app *application) rateLimit(next http.Handler) http.Handler {
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
-	}
+// clientLimiter keeps a token bucket rate limiter for each client IP address. Clients
+// which haven't been seen for three minutes are forgotten.
+type clientLimiter struct {
+	rps   float64
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*limitedClient
+}
 
-	var (
-		mu      sync.Mutex
-		clients = make(map[string]*client)
-	)
+type limitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newClientLimiter(rps float64, burst int) *clientLimiter {
+	l := &clientLimiter{
+		rps:     rps,
+		burst:   burst,
+		clients: make(map[string]*limitedClient),
+	}
 
 	go func() {
 		for {
 			time.Sleep(time.Minute)
 
-			mu.Lock()
+			l.mu.Lock()
 
-			for ip, client := range clients {
+			for ip, client := range l.clients {
 				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
+					delete(l.clients, ip)
 				}
 			}
 
-			mu.Unlock()
+			l.mu.Unlock()
 		}
 	}()
 
+	return l
+}
+
+// allow reports whether the client with the given IP address may make a request now.
+func (l *clientLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Check to see if the IP address already exists in the map. If it doesn't, then
+	// initialize a new rate limiter and add the IP address and limiter to the map.
+	if _, found := l.clients[ip]; !found {
+		l.clients[ip] = &limitedClient{limiter: rate.NewLimiter(rate.Limit(l.rps), l.burst)}
+	}
+
+	// Update the last seen time for the client.
+	l.clients[ip].lastSeen = time.Now()
+
+	return l.clients[ip].limiter.Allow()
+}
+
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	limiter := newClientLimiter(app.config.limiter.rps, app.config.limiter.burst)
+
+	// Title suggestions are requested on every keystroke, so they're counted in a
+	// separate, more generous bucket which doesn't eat into the client's allowance for
+	// everything else.
+	suggestLimiter := newClientLimiter(app.config.limiter.suggestRPS, app.config.limiter.suggestBurst)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if app.config.limiter.enabled {
 			// Extract the client's IP address from the request.
@@ -63,32 +102,16 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 				return
 			}
 
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
-
-			// Check to see if the IP address already exists in the map. If it doesn't, then
-			// initialize a new rate limiter and add the IP address and limiter to the map.
-			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(2, 4)}
+			bucket := limiter
+			if r.URL.Path == "/v1/movies/suggest" {
+				bucket = suggestLimiter
 			}
 
-			// Update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
-
-			// Call the Allow() method on the rate limiter for the current IP address. If
-			// the request isn't allowed, unlock the mutex and send a 429 Too Many Requests
-			// response, just like before.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
+			// If the request isn't allowed, send a 429 Too Many Requests response.
+			if !bucket.allow(ip) {
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
-
-			// Very importantly, unlock the mutex before calling the next handler in the
-			// chain. Notice that we DON'T use defer to unlock the mutex, as that would mean
-			// that the mutex isn't unlocked until all the handlers downstream of this
-			// middleware have also returned.
-			mu.Unlock()
 		}
 
 		next.ServeHTTP(w, r)
@@ -114,13 +137,28 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		token := headerParts[1]
 
+		// Signed tokens carry everything needed to authenticate the request, so
+		// they're checked without going to the database.
+		if app.signer != nil {
+			user, session, err := app.authenticateSigned(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetSession(r, session)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		v := validator.New()
 		if data.ValidateTokenPlainText(v, token); !v.Valid() {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, session, err := app.models.Users.GetForSession(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -131,7 +169,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Recording every single use would mean a write on every request, so a session
+		// is only touched once a minute at most.
+		if session.LastUsedAt == nil || time.Since(*session.LastUsedAt) > time.Minute {
+			if err := app.models.Tokens.TouchSession(session.ID, clientIP(r), r.UserAgent()); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetSession(r, session)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -192,10 +240,11 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed, Email-Change-Pending")
 
 					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Match, If-None-Match")
 
 						w.WriteHeader(http.StatusOK)
 						return
@@ -3,9 +3,16 @@ package main
 import (
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/jsonpatch"
 	"github.com/jandiralceu/greenlight/internal/validator"
 )
 
@@ -31,15 +38,28 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	v := validator.New()
 
+	// Swap the genres for their canonical names before validating, so that
+	// spellings like "sci-fi" and "Sci-Fi" are caught as duplicates.
+	if err := app.canonicalizeGenres(v, movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	if data.ValidateMovie(v, movie); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Refuse likely duplicates unless the client has confirmed, with ?force=true,
+	// that this really is a different film, such as a remake.
+	if !app.checkDuplicateMovie(w, r, movie) {
+		return
+	}
+
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
 	// movie struct with the system-generated information.
-	if err := app.models.Movies.Insert(movie); err != nil {
+	if err := app.models.Movies.Insert(movie, app.contextGetUser(r).ID); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
@@ -50,6 +70,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// interpolating the system-generated ID for our new movie in the URL.
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+	headers.Set("ETag", movieETag(movie))
 
 	// Write a JSON response with a 201 Created status code, the movie data in the // response body, and the Location header.
 	if err := app.writeJSON(w, http.StatusCreated, movie, headers); err != nil {
@@ -64,11 +85,32 @@ func (app *application) showMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Call the Get() method to fetch the data for a specific movie. We also need to
-	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
+	// Clients can ask for a sparse fieldset, such as ?fields=id,title, in which case
+	// only those columns are read from the database. Related resources can be embedded
+	// with ?include=credits.
+	fields := app.readCSV(r.URL.Query(), "fields", nil)
+	include := app.readCSV(r.URL.Query(), "include", nil)
+
+	v := validator.New()
+
+	locales := app.readLocales(r, v)
+
+	data.ValidateMovieFields(v, fields)
+
+	for _, name := range include {
+		v.Check(validator.PermittedValue(name, "credits"), "include", "invalid include "+name)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Call the GetFields() method to fetch the data for a specific movie. We also need
+	// to use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.GetFields(id, fields)
 
 	if err != nil {
 		switch {
@@ -81,56 +123,138 @@ func (app *application) showMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusOK, movie, nil); err != nil {
+	// Images are left out of sparse fieldsets, which only ever contain columns.
+	if len(fields) == 0 {
+		if err := app.attachImages(movie); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := app.localizeTitles(fields, locales, movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Vary", "Accept-Language")
+
+	if movie.TitleLocale != "" {
+		headers.Set("Content-Language", movie.TitleLocale)
+	}
+
+	if slices.Contains(include, "credits") {
+		movie.Credits, err = app.models.Credits.GetAllForMovie(movie.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// Credits and localized titles are edited without touching the movie version, so
+	// a response containing them can't be tagged with it and is always sent in full.
+	if movie.Credits != nil || movie.TitleLocale != "" {
+		if err := app.writeJSON(w, http.StatusOK, movie, headers); err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// A client holding the current entity tag can revalidate its copy without
+	// downloading it again. A sparse fieldset is a different representation, so it
+	// gets a tag of its own, which conditional updates won't accept.
+	etag := movieETag(movie, fields...)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag, true) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Vary", "Accept-Language")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	headers.Set("ETag", etag)
+
+	if err := app.writeJSON(w, http.StatusOK, movie, headers); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
-	// To keep things consistent with our other handlers, we'll define an input struct
-	// to hold the expected values from the request query string.
-	var input struct {
-		Title  string
-		Genres []string
-		data.Filters
+// movieETag returns the entity tag for the current state of a movie. Reviews and
+// images change it without touching the version, so the rating fields and the IDs of
+// the attached images are folded into the tag alongside it. The fields of a sparse
+// fieldset are too, in a fixed order, since the order they're asked for in doesn't
+// change the response.
+func movieETag(movie *data.Movie, fields ...string) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d:%g", movie.RatingCount, movie.AverageRating)
+
+	for _, image := range movie.Images {
+		fmt.Fprintf(h, ":%d", image.ID)
+	}
+
+	if len(fields) > 0 {
+		fmt.Fprintf(h, ":%s", strings.Join(slices.Compact(slices.Sorted(slices.Values(fields))), ","))
 	}
 
+	return fmt.Sprintf(`"%d-%x"`, movie.Version, h.Sum32())
+}
+
+func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listMovies(w, r, false)
+}
+
+// listDeletedMoviesHandler lists the movies in the trash, accepting the same search,
+// sort and pagination parameters as listMoviesHandler.
+func (app *application) listDeletedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listMovies(w, r, true)
+}
+
+func (app *application) listMovies(w http.ResponseWriter, r *http.Request, deleted bool) {
 	// Initialize a new Validator instance.
 	v := validator.New()
 
-	// Call r.URL.Query() to get the url.Values map containing the query string data.
-	qs := r.URL.Query()
+	// Call r.URL.Query() to get the url.Values map containing the query string data,
+	// and read the search criteria and pagination parameters from it.
+	search, filters := app.readMovieListInput(r.URL.Query(), v)
+	search.Deleted = deleted
 
-	// Use our helpers to extract the title and genres query string values, falling back
-	// to defaults of an empty string and an empty slice respectively if they are not
-	// provided by the client.
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	locales := app.readLocales(r, v)
 
-	// Get the page and page_size query string values as integers. Notice that we set
-	// the default page value to 1 and default page_size to 20, and that we pass the
-	// validator instance as the final argument here.
-	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Facet counts are opt-in, as they cost an extra query over every matching movie.
+	facets := app.readCSV(r.URL.Query(), "facets", nil)
 
-	// Extract the sort query string value, falling back to "id" if it is not provided
-	// by the client (which will imply a ascending sort on movie ID).
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-
-	// Add the supported sort values for this endpoint to the sort safelist.
-	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	// Execute the validation checks on the search criteria and the Filters struct and
+	// send a response containing the errors if necessary.
+	data.ValidateMovieSearch(v, search)
+	data.ValidateMovieFacets(v, facets)
 
-	// Execute the validation checks on the Filters struct and send a response
-	// containing the errors if necessary.
-	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+	if data.ValidateFilters(v, filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the GetAll() method to retrieve the movies, passing in the various filter
 	// parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(search, filters)
 	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidCursor):
+			v.AddError("cursor", "must be a valid cursor")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if len(search.Fields) == 0 {
+		if err := app.attachImages(movies...); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := app.localizeTitles(search.Fields, locales, movies...); err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
@@ -140,12 +264,75 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		"metadata": metadata,
 	}
 
+	// The counts cover every movie matching the search, not just the current page.
+	if len(facets) > 0 {
+		counts, err := app.models.Movies.Facets(search, facets)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		response["facets"] = counts
+	}
+
+	headers := make(http.Header)
+	headers.Set("Vary", "Accept-Language")
+
 	// Send a JSON response containing the movie data.
-	if err := app.writeJSON(w, http.StatusOK, &response, nil); err != nil {
+	if err := app.writeJSON(w, http.StatusOK, &response, headers); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// readMovieListInput extracts the movie search criteria and the pagination and sort
+// parameters shared by the movie listing endpoints from the query string. Any values
+// which can't be parsed are recorded in the Validator.
+func (app *application) readMovieListInput(qs url.Values, v *validator.Validator) (data.MovieSearch, data.Filters) {
+	// To keep things consistent with our other handlers, we'll define an input struct
+	// to hold the expected values from the request query string.
+	var input struct {
+		data.MovieSearch
+		data.Filters
+	}
+
+	// Use our helpers to extract the title and genres query string values, falling back
+	// to defaults of an empty string and an empty slice respectively if they are not
+	// provided by the client.
+	input.Title = app.readString(qs, "title", "")
+	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.Highlight = app.readBool(qs, "highlight", false, v)
+	input.Fields = app.readCSV(qs, "fields", nil)
+
+	// The range filters are all optional, with zero meaning "unbounded". Runtimes use
+	// the same "<runtime> mins" format as the JSON representation.
+	input.GenreMode = app.readString(qs, "genre_mode", "all")
+	input.YearMin = app.readInt(qs, "year_min", 0, v)
+	input.YearMax = app.readInt(qs, "year_max", 0, v)
+	input.RuntimeMin = app.readRuntime(qs, "runtime_min", 0, v)
+	input.RuntimeMax = app.readRuntime(qs, "runtime_max", 0, v)
+	input.Person = int64(app.readInt(qs, "person", 0, v))
+
+	// Get the page and page_size query string values as integers. Notice that we set
+	// the default page value to 1 and default page_size to 20, and that we pass the
+	// validator instance as the final argument here.
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Extract the sort query string value, falling back to "id" if it is not provided
+	// by the client (which will imply a ascending sort on movie ID).
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+
+	// Add the supported sort values for this endpoint to the sort safelist.
+	input.Filters.SortSafeList = []string{"id", "title", "year", "runtime", "relevance", "rating", "-id", "-title", "-year", "-runtime", "-relevance", "-rating"}
+
+	// Keyset pagination is opt-in: the presence of a cursor parameter (empty for the
+	// first page) switches the listing over from page/page_size offsets.
+	input.Filters.UseCursor = qs.Has("cursor")
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+
+	return input.MovieSearch, input.Filters
+}
+
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -166,6 +353,98 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if err := app.attachImages(movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// If the client sent an If-Match header, only go ahead when it still matches the
+	// version we've just read. Otherwise someone else has changed the movie since the
+	// client last fetched it.
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, movieETag(movie), false) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	title, year := movie.Title, movie.Year
+
+	// A plain JSON body only changes the fields it contains. Clients can also send a
+	// JSON Merge Patch or a JSON Patch, which can clear fields and add or remove single
+	// genres. Either way the result is validated just the same.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "", "application/json":
+		if err := app.readMovieUpdate(w, r, movie); err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	case "application/merge-patch+json", "application/json-patch+json":
+		if err := app.patchMovie(w, r, movie, mediaType); err != nil {
+			var patchError *jsonpatch.Error
+
+			switch {
+			case errors.As(err, &patchError):
+				app.failedValidationResponse(w, r, map[string]string{"patch": patchError.Error()})
+			default:
+				app.badRequestResponse(w, r, err)
+			}
+			return
+		}
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
+	// response if any checks fail.
+	v := validator.New()
+
+	// Swap the genres for their canonical names before validating, so that
+	// spellings like "sci-fi" and "Sci-Fi" are caught as duplicates.
+	if err := app.canonicalizeGenres(v, movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Only a change of title or year can turn the movie into a duplicate.
+	if (movie.Title != title || movie.Year != year) && !app.checkDuplicateMovie(w, r, movie) {
+		return
+	}
+
+	// Pass the updated movie record to our new Update() method. An edit conflict
+	// means the version changed after we read it, which for a conditional request is
+	// a failed precondition.
+	if err := app.models.Movies.Update(movie, app.contextGetUser(r).ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("ETag", movieETag(movie))
+
+	// Write the updated movie record in a JSON response.
+	if err := app.writeJSON(w, http.StatusOK, movie, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readMovieUpdate applies a plain JSON update to a movie, leaving any fields which
+// aren't in the request body as they are.
+func (app *application) readMovieUpdate(w http.ResponseWriter, r *http.Request, movie *data.Movie) error {
 	// Declare an input struct to hold the expected data from the client.
 	var input struct {
 		Title   *string       `json:"title"`
@@ -176,8 +455,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Decode the JSON as normal.
 	if err := app.readJSON(w, r, &input); err != nil {
-		app.badRequestResponse(w, r, err)
-		return
+		return err
 	}
 
 	// If the input.Title value is nil then we know that no corresponding "title" key/
@@ -202,18 +480,50 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		movie.Genres = input.Genres
 	}
 
-	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
-	// response if any checks fail.
-	v := validator.New()
+	return nil
+}
 
-	if data.ValidateMovie(v, movie); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
+	// Extract the movie ID from the URL.
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Fetch the movie so that the delete can be made conditional on the version we
+	// saw, the same way updates are.
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.attachImages(movie); err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Pass the updated movie record to our new Update() method.
-	if err := app.models.Movies.Update(movie); err != nil {
+	// For a conditional delete, check the client's If-Match header against the
+	// version currently stored before going any further.
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, movieETag(movie), false) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	// Move the movie to the trash. An edit conflict means the movie was changed or
+	// deleted after we read it, which for a conditional request is a failed
+	// precondition.
+	if err = app.models.Movies.Delete(id, movie.Version); err != nil {
 		switch {
+		case errors.Is(err, data.ErrEditConflict) && ifMatch != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -222,23 +532,65 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Write the updated movie record in a JSON response.
+	// Return a 200 OK status code along with a success message.
+	if err := app.writeJSON(w, http.StatusOK, nil, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Take the movie out of the trash, sending a 404 Not Found response if there
+	// isn't a deleted movie with this ID.
+	if err := app.models.Movies.Restore(id); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	if err := app.writeJSON(w, http.StatusOK, movie, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the movie ID from the URL.
+func (app *application) purgeMovieHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
-	// Delete the movie from the database, sending a 404 Not Found response to the
-	// client if there isn't a matching record.
-	if err = app.models.Movies.Delete(id); err != nil {
+	// Look up the movie's images first, as their rows go along with the movie and we
+	// still need them to find the files to remove.
+	images, err := app.models.Images.GetAllForMovies([]int64{id})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Permanently remove the movie. Only movies which are already in the trash can be
+	// purged, so anything else is reported as not found.
+	if err := app.models.Movies.Purge(id); err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
@@ -248,8 +600,142 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Return a 200 OK status code along with a success message.
+	app.deleteImageFiles(images[id]...)
+
 	if err := app.writeJSON(w, http.StatusOK, nil, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// purgeExpiredMovies periodically purges the movies which have been in the trash for
+// longer than the configured retention window. A zero window disables it.
+func (app *application) purgeExpiredMovies() {
+	if app.config.trash.retention <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			cutoff := time.Now().Add(-app.config.trash.retention)
+
+			if err := app.purgeMoviesDeletedBefore(cutoff); err != nil {
+				app.logger.Error(err.Error())
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// purgeMoviesDeletedBefore purges the movies trashed before the cutoff, along with
+// their image files. Images are looked up beforehand, but only the files of movies
+// which were actually purged are removed, in case one was restored in the meantime.
+func (app *application) purgeMoviesDeletedBefore(cutoff time.Time) error {
+	images, err := app.models.Images.GetAllForMoviesDeletedBefore(cutoff)
+	if err != nil {
+		return err
+	}
+
+	ids, err := app.models.Movies.PurgeDeletedBefore(cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		app.deleteImageFiles(images[id]...)
+	}
+
+	if len(ids) > 0 {
+		app.logger.Info("purged expired movies from the trash", "count", len(ids))
+	}
+
+	return nil
+}
+
+// checkDuplicateMovie looks for existing movies which are likely duplicates of the
+// given one and, if there are any, sends a 409 Conflict response listing them. The
+// check is skipped when the request has ?force=true. It returns false if a response
+// has been sent.
+func (app *application) checkDuplicateMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie) bool {
+	v := validator.New()
+
+	if force := app.readBool(r.URL.Query(), "force", false, v); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	} else if force {
+		return true
+	}
+
+	duplicates, err := app.findDuplicateMovies(movie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if len(duplicates) == 0 {
+		return true
+	}
+
+	app.duplicateMovieResponse(w, r, duplicates)
+	return false
+}
+
+// findDuplicateMovies returns the likely duplicates of a movie, each with a link to
+// the existing movie.
+func (app *application) findDuplicateMovies(movie *data.Movie) ([]*data.MovieDuplicate, error) {
+	duplicates, err := app.models.Movies.FindDuplicates(movie)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, duplicate := range duplicates {
+		duplicate.Link = fmt.Sprintf("/v1/movies/%d", duplicate.ID)
+	}
+
+	return duplicates, nil
+}
+
+// suggestMoviesHandler returns a handful of titles matching the text typed so far, for
+// autocompletion. Unlike listMoviesHandler there's no count or pagination, and only
+// the id, title and year of each movie are read.
+func (app *application) suggestMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+
+	q := app.readString(qs, "q", "")
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(len(q) <= 200, "q", "must not be more than 200 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Movies.Suggest(q, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Let clients reuse suggestions for a prefix they've already typed, such as after
+	// a backspace, for a short while.
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "private, max-age=60")
+
+	if err := app.writeJSON(w, http.StatusOK, map[string]interface{}{"suggestions": suggestions}, headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// localizeTitles swaps the titles of the movies for localized ones, unless the client
+// asked for a sparse fieldset without the title.
+func (app *application) localizeTitles(fields, locales []string, movies ...*data.Movie) error {
+	if len(fields) > 0 && !slices.Contains(fields, "title") {
+		return nil
+	}
+
+	return app.models.Titles.Localize(movies, locales)
+}
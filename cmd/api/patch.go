@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/jsonpatch"
+)
+
+// movieDocument is the JSON document which patches to a movie are applied to. It only
+// holds the fields clients can edit, so a patch can't touch the id or version. Year
+// and runtime are left out when they're zero, so that clearing them with a patch and
+// reading them back agree.
+type movieDocument struct {
+	Title   string       `json:"title"`
+	Year    int32        `json:"year,omitempty"`
+	Runtime data.Runtime `json:"runtime,omitempty"`
+	Genres  []string     `json:"genres"`
+}
+
+// patchMovie applies the JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902) in the
+// request body to a movie, depending on the media type. A patch which is well-formed
+// but can't be applied, such as one removing a genre which isn't there, is reported
+// as a *jsonpatch.Error.
+func (app *application) patchMovie(w http.ResponseWriter, r *http.Request, movie *data.Movie, mediaType string) error {
+	var patch json.RawMessage
+
+	if err := app.readJSON(w, r, &patch); err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(movieDocument{
+		Title:   movie.Title,
+		Year:    movie.Year,
+		Runtime: movie.Runtime,
+		Genres:  movie.Genres,
+	})
+	if err != nil {
+		return err
+	}
+
+	if mediaType == "application/merge-patch+json" {
+		doc, err = jsonpatch.MergePatch(doc, patch)
+	} else {
+		doc, err = jsonpatch.Apply(doc, patch)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Decode the patched document as strictly as a request body, so that a patch
+	// adding an unknown field or giving one the wrong type is rejected.
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+
+	var patched movieDocument
+
+	if err := decoder.Decode(&patched); err != nil {
+		return jsonDecodeError(err)
+	}
+
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("patch must result in a single JSON object")
+	}
+
+	movie.Title = patched.Title
+	movie.Year = patched.Year
+	movie.Runtime = patched.Runtime
+	movie.Genres = patched.Genres
+
+	return nil
+}
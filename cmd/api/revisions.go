@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/validator"
+)
+
+func (app *application) listMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	var filters data.Filters
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = app.readString(qs, "sort", "-version")
+	filters.SortSafeList = []string{"version", "-version"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Make sure the movie exists, so that an unknown ID is a 404 rather than an empty
+	// history.
+	if _, err := app.models.Movies.Get(id); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	revisions, metadata, err := app.models.Revisions.GetAllForMovie(id, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"revisions": revisions,
+		"metadata":  metadata,
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) diffMovieRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	from := app.readInt(qs, "from", 0, v)
+	to := app.readInt(qs, "to", 0, v)
+
+	v.Check(from > 0, "from", "must be a positive version number")
+	v.Check(to > 0, "to", "must be a positive version number")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	fromRevision, ok := app.readRevision(w, r, v, id, "from", from)
+	if !ok {
+		return
+	}
+
+	toRevision, ok := app.readRevision(w, r, v, id, "to", to)
+	if !ok {
+		return
+	}
+
+	response := map[string]interface{}{
+		"from":    fromRevision.Version,
+		"to":      toRevision.Version,
+		"changes": data.DiffMovieRevisions(fromRevision, toRevision),
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, response, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revertMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	version := app.readInt(r.URL.Query(), "version", 0, v)
+	if v.Check(version > 0, "version", "must be a positive version number"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if v.Check(int32(version) != movie.Version, "version", "is already the current version"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	revision, ok := app.readRevision(w, r, v, id, "version", version)
+	if !ok {
+		return
+	}
+
+	// Reverting is just another update: the old field values are copied onto the
+	// current record, validated as normal and saved against the version we read, so a
+	// concurrent edit still results in an edit conflict.
+	// The genres are canonicalized again, in case they have been renamed or merged
+	// since the revision was saved.
+	revision.Apply(movie)
+
+	if err := app.canonicalizeGenres(v, movie); err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if data.ValidateMovie(v, movie); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if err := app.models.Movies.Update(movie, app.contextGetUser(r).ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if err := app.writeJSON(w, http.StatusOK, movie, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readRevision fetches a single revision of a movie for one of the handlers above. If
+// it can't be found a validation error is sent against the given query string key,
+// and false is returned when a response has already been written.
+func (app *application) readRevision(w http.ResponseWriter, r *http.Request, v *validator.Validator, movieID int64, key string, version int) (*data.MovieRevision, bool) {
+	revision, err := app.models.Revisions.Get(movieID, int32(version))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError(key, "no matching revision found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return revision, true
+}
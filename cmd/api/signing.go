@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/data"
+	"github.com/jandiralceu/greenlight/internal/jwt"
+)
+
+// tokenClaims are the claims of a signed authentication token. The token's ID is the
+// hash its tokens table row is stored under, and the session ID is that row's ID, so
+// that a signed token can be listed and revoked like any other session.
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ID        string `json:"jti"`
+	SessionID int64  `json:"sid"`
+	Activated bool   `json:"activated"`
+	IssuedAt  int64  `json:"iat"`
+	Expiry    int64  `json:"exp"`
+}
+
+// signAuthenticationToken replaces the plaintext of a newly created authentication
+// token with a signed token standing in for it. The random plaintext is never handed
+// out, so the row can't be used as an opaque token.
+func (app *application) signAuthenticationToken(token *data.Token, activated bool) error {
+	claims := tokenClaims{
+		Subject:   strconv.FormatInt(token.UserID, 10),
+		ID:        hex.EncodeToString(token.Hash),
+		SessionID: token.ID,
+		Activated: activated,
+		IssuedAt:  time.Now().Unix(),
+		Expiry:    token.Expiry.Unix(),
+	}
+
+	signed, err := app.signer.Sign(claims)
+	if err != nil {
+		return err
+	}
+
+	token.PlainText = signed
+	return nil
+}
+
+// authenticateSigned verifies a signed authentication token without touching the
+// database. The user it returns only carries what the token does: their ID and
+// whether they were activated when it was issued.
+func (app *application) authenticateSigned(token string) (*data.User, *data.Session, error) {
+	var claims tokenClaims
+
+	if err := app.signer.Verify(token, &claims); err != nil {
+		return nil, nil, err
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	if app.revocations.contains(claims.ID) {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	user := &data.User{ID: id, Activated: claims.Activated}
+	session := &data.Session{ID: claims.SessionID, Current: true}
+
+	return user, session, nil
+}
+
+// revocationList holds the IDs of signed tokens which were revoked before they
+// expired, along with their expiry so that they can be dropped once they have.
+type revocationList struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+	synced  time.Time
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{revoked: make(map[string]time.Time)}
+}
+
+func (l *revocationList) contains(id string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, found := l.revoked[id]
+	return found
+}
+
+// syncRevocations loads the tokens revoked since the last sync. Revocations are looked
+// for a minute further back than that, in case a transaction which revoked a token
+// committed after a sync which started later than it did.
+func (app *application) syncRevocations() error {
+	app.revocations.mu.RLock()
+	since := app.revocations.synced.Add(-time.Minute)
+	app.revocations.mu.RUnlock()
+
+	revoked, err := app.models.Tokens.GetRevokedSince(since)
+	if err != nil {
+		return err
+	}
+
+	l := app.revocations
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, token := range revoked {
+		l.revoked[hex.EncodeToString(token.Hash)] = token.Expiry
+
+		if token.RevokedAt.After(l.synced) {
+			l.synced = token.RevokedAt
+		}
+	}
+
+	for id, expiry := range l.revoked {
+		if time.Now().After(expiry) {
+			delete(l.revoked, id)
+		}
+	}
+
+	return nil
+}
+
+// refreshRevocations picks up tokens which were just revoked, so that a user who logs
+// out isn't still logged in until the next periodic sync.
+func (app *application) refreshRevocations() {
+	if app.signer == nil {
+		return
+	}
+
+	if err := app.syncRevocations(); err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// watchRevocations periodically syncs the revocation list, which picks up tokens
+// revoked by other instances of the API.
+func (app *application) watchRevocations() {
+	go func() {
+		for {
+			time.Sleep(app.config.tokens.revocationSync)
+
+			if err := app.syncRevocations(); err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+	}()
+}
+
+// purgeExpiredRevocations periodically removes revoked tokens which have expired.
+func (app *application) purgeExpiredRevocations() {
+	go func() {
+		for {
+			count, err := app.models.Tokens.DeleteExpiredRevocations()
+			if err != nil {
+				app.logger.Error(err.Error())
+			} else if count > 0 {
+				app.logger.Info("purged expired token revocations", "count", count)
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// jwksHandler publishes the public keys signed authentication tokens can be verified
+// with.
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	if err := app.writeJSON(w, http.StatusOK, app.signer.JWKS(), headers); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
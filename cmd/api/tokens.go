@@ -50,16 +50,105 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	access, refresh, err := app.models.Tokens.NewSession(user.ID, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, clientIP(r), r.UserAgent())
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	if err := app.writeJSON(w, http.StatusCreated, token, nil); err != nil {
+	if app.signer != nil {
+		if err := app.signAuthenticationToken(access, user.Activated); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := app.writeJSON(w, http.StatusCreated, map[string]interface{}{"authentication_token": access, "refresh_token": refresh}, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokensHandler exchanges a refresh token for a new authentication and refresh
+// token pair.
+func (app *application) refreshTokensHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(len(input.RefreshToken) == 26, "refresh_token", "must be 26 bytes long"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	access, refresh, err := app.models.Tokens.Rotate(input.RefreshToken, app.config.tokens.accessTTL, app.config.tokens.refreshTTL, clientIP(r), r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn("refresh token reused, token family revoked", "ip", clientIP(r))
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("refresh_token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	// The rotation revoked the family's previous authentication token.
+	app.refreshRevocations()
+
+	if app.signer != nil {
+		user, err := app.models.Users.Get(access.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if err := app.signAuthenticationToken(access, user.Activated); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if err := app.writeJSON(w, http.StatusCreated, map[string]interface{}{"authentication_token": access, "refresh_token": refresh}, nil); err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// deleteAuthenticationTokenHandler logs the user out by revoking the token the request
+// was authenticated with.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	session := app.contextGetSession(r)
+
+	if err := app.models.Tokens.DeleteSession(user.ID, session.ID); err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	app.refreshRevocations()
+
+	if err := app.writeJSON(w, http.StatusOK, nil, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email string `json:"email"`
@@ -173,3 +262,64 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	if err := app.readJSON(w, r, &input); err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("email", "no matching record found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+
+		return
+	}
+
+	if !user.Activated {
+		v.AddError("email", "user account must be activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		values := map[string]interface{}{
+			"passwordResetToken": token.PlainText,
+		}
+
+		if err := app.mailer.Send(user.Email, "token_password_reset.tmpl", values); err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	message := map[string]interface{}{
+		"message": "an email will be sent to you containing password reset instructions",
+	}
+
+	if err := app.writeJSON(w, http.StatusAccepted, message, nil); err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
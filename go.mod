@@ -2,16 +2,18 @@ module github.com/jandiralceu/greenlight
 
 go 1.23.0
 
-require github.com/julienschmidt/httprouter v1.3.0
+require (
+	github.com/go-mail/mail/v2 v2.3.0
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.9
+	github.com/subosito/gotenv v1.6.0
+	golang.org/x/crypto v0.28.0
+	golang.org/x/time v0.7.0
+)
 
 require (
 	github.com/Rhymond/go-money v1.0.14 // indirect
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
 	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/subosito/gotenv v1.6.0 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/text v0.19.0 // indirect
-	golang.org/x/time v0.7.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
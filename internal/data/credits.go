@@ -0,0 +1,200 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/validator"
+)
+
+var (
+	ErrDuplicateCredit = errors.New("duplicate credit")
+)
+
+// CreditRoles holds the roles a person can be credited with, in the order credits
+// are listed.
+var CreditRoles = []string{"director", "writer", "cast"}
+
+// Credit links a person to a movie. Character is only used for the cast, and
+// BillingOrder ranks the credits within a role, lowest first.
+type Credit struct {
+	ID           int64  `json:"id"`
+	MovieID      int64  `json:"movie_id"`
+	PersonID     int64  `json:"person_id"`
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	Character    string `json:"character,omitempty"`
+	BillingOrder int32  `json:"billing_order"`
+	Version      int32  `json:"version"`
+}
+
+func ValidateCredit(v *validator.Validator, credit *Credit) {
+	v.Check(credit.PersonID > 0, "person_id", "must be provided")
+
+	v.Check(validator.PermittedValue(credit.Role, CreditRoles...), "role", "must be one of director, writer or cast")
+
+	v.Check(credit.Character == "" || credit.Role == "cast", "character", "must only be provided for the cast")
+	v.Check(len(credit.Character) <= 500, "character", "must not be more than 500 bytes long")
+
+	v.Check(credit.BillingOrder >= 0, "billing_order", "must not be negative")
+}
+
+type CreditModel struct {
+	DB *sql.DB
+}
+
+// creditQuery reads credits along with the name of the person they belong to.
+const creditQuery = `
+	SELECT c.id, c.movie_id, c.person_id, p.name, c.role, c.character, c.billing_order, c.version
+	FROM credits c
+	JOIN people p ON p.id = c.person_id`
+
+func (c *Credit) scanTargets() []any {
+	return []any{&c.ID, &c.MovieID, &c.PersonID, &c.Name, &c.Role, &c.Character, &c.BillingOrder, &c.Version}
+}
+
+// Insert adds a credit. The person's name is read back so that the credit can be
+// returned as it would be listed.
+func (m CreditModel) Insert(credit *Credit) error {
+	query := `
+		WITH credit AS (
+			INSERT INTO credits (movie_id, person_id, role, character, billing_order)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, person_id, version
+		)
+		SELECT credit.id, credit.version, p.name
+		FROM credit
+		JOIN people p ON p.id = credit.person_id`
+
+	args := []any{credit.MovieID, credit.PersonID, credit.Role, credit.Character, credit.BillingOrder}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.ID, &credit.Version, &credit.Name)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "credits_movie_id_person_id_role_character_key"`:
+			return ErrDuplicateCredit
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m CreditModel) Get(id int64) (*Credit, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	var credit Credit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, creditQuery+` WHERE c.id = $1`, id).Scan(credit.scanTargets()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &credit, nil
+}
+
+// GetAllForMovie returns every credit for a movie, grouped by role and then in billing
+// order.
+func (m CreditModel) GetAllForMovie(movieID int64) ([]*Credit, error) {
+	query := creditQuery + `
+		WHERE c.movie_id = $1
+		ORDER BY array_position(ARRAY['director', 'writer', 'cast'], c.role), c.billing_order, c.id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credits := []*Credit{}
+
+	for rows.Next() {
+		var credit Credit
+
+		if err := rows.Scan(credit.scanTargets()...); err != nil {
+			return nil, err
+		}
+
+		credits = append(credits, &credit)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return credits, nil
+}
+
+// Update saves changes to the role, character and billing order of a credit. The
+// movie and person it links can't be changed; delete the credit and add a new one
+// instead.
+func (m CreditModel) Update(credit *Credit) error {
+	query := `
+		UPDATE credits
+		SET role = $1, character = $2, billing_order = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version`
+
+	args := []any{credit.Role, credit.Character, credit.BillingOrder, credit.ID, credit.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&credit.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case err.Error() == `pq: duplicate key value violates unique constraint "credits_movie_id_person_id_role_character_key"`:
+			return ErrDuplicateCredit
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m CreditModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM credits WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
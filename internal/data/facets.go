@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/validator"
+)
+
+// MovieFacetSafeList holds the facets which movies can be counted by.
+var MovieFacetSafeList = []string{"genres", "decade", "runtime_bucket"}
+
+// FacetCount is the number of movies matching a search which share a facet value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// movieFacetQueries holds, for each facet, a query over the matched movies returning
+// the facet value, a key to order the values by and the count. Genres are ordered
+// most common first, decades and runtime buckets in their natural order.
+var movieFacetQueries = map[string]string{
+	"genres": `
+		SELECT 'genres', genre, -count(*), count(*)
+		FROM matched, unnest(genres) AS genre
+		GROUP BY genre`,
+	"decade": `
+		SELECT 'decade', (year / 10 * 10) || 's', year / 10 * 10, count(*)
+		FROM matched
+		GROUP BY year / 10 * 10`,
+	"runtime_bucket": `
+		SELECT 'runtime_bucket', bucket.label, bucket.position, count(*)
+		FROM matched, LATERAL (
+			SELECT * FROM (VALUES
+				(0, 'unknown', runtime = 0),
+				(1, '0-89', runtime BETWEEN 1 AND 89),
+				(2, '90-119', runtime BETWEEN 90 AND 119),
+				(3, '120-149', runtime BETWEEN 120 AND 149),
+				(4, '150+', runtime >= 150)
+			) AS buckets (position, label, matches)
+			WHERE matches
+		) AS bucket
+		GROUP BY bucket.label, bucket.position`,
+}
+
+func ValidateMovieFacets(v *validator.Validator, facets []string) {
+	for _, facet := range facets {
+		v.Check(validator.PermittedValue(facet, MovieFacetSafeList...), "facets", "invalid facet "+facet)
+	}
+
+	v.Check(validator.Unique(facets), "facets", "must not contain duplicate facets")
+}
+
+// Facets counts the movies matching the search criteria by each of the requested
+// facets. The matching movies are found once and shared by every facet, so asking for
+// several costs little more than asking for one.
+func (m MovieModel) Facets(search MovieSearch, facets []string) (map[string][]FacetCount, error) {
+	result := make(map[string][]FacetCount, len(facets))
+
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	where, args := search.conditions()
+
+	// The facet names have been checked against MovieFacetSafeList, so only our own
+	// queries make it into the SQL.
+	parts := make([]string, len(facets))
+	for i, facet := range facets {
+		parts[i] = movieFacetQueries[facet]
+		result[facet] = []FacetCount{}
+	}
+
+	query := fmt.Sprintf(`
+		WITH matched AS MATERIALIZED (
+			SELECT genres, year, runtime
+			FROM movies
+			%s
+		)
+		SELECT facet, value, sort_key, count FROM (%s) AS facets (facet, value, sort_key, count)
+		ORDER BY facet, sort_key, value`, where, strings.Join(parts, " UNION ALL "))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			facet   string
+			sortKey int64
+			count   FacetCount
+		)
+
+		if err := rows.Scan(&facet, &count.Value, &sortKey, &count.Count); err != nil {
+			return nil, err
+		}
+
+		result[facet] = append(result[facet], count)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
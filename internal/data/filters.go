@@ -1,18 +1,25 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"strings"
 
 	"github.com/jandiralceu/greenlight/internal/validator"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 // Metadata Define a struct for holding the pagination metadata.
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 type Filters struct {
@@ -20,6 +27,45 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafeList []string
+	// UseCursor switches the listing from page/offset pagination to keyset
+	// pagination. Cursor holds the opaque token returned in a previous Metadata, and
+	// is empty when the client is asking for the first page.
+	UseCursor bool
+	Cursor    string
+}
+
+// cursor is the decoded form of the opaque keyset pagination token. It records the
+// sort that was active when it was issued, the value of the sort column and the id of
+// the boundary row, and whether it points backwards (to the previous page).
+type cursor struct {
+	Sort     string          `json:"s"`
+	Value    json.RawMessage `json:"v"`
+	ID       int64           `json:"i"`
+	Backward bool            `json:"b,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(js, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -76,4 +122,18 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
+
+	// A cursor must decode cleanly and must have been issued for the same sort order,
+	// otherwise the keyset comparison would silently jump to an unrelated position.
+	if f.UseCursor && f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			v.AddError("cursor", "must be a valid cursor")
+			return
+		}
+
+		v.Check(c.Sort == f.Sort, "cursor", "does not match the sort parameter")
+		v.Check(c.ID > 0, "cursor", "must be a valid cursor")
+		v.Check(len(c.Value) > 0, "cursor", "must be a valid cursor")
+	}
 }
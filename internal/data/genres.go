@@ -0,0 +1,324 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateGenre = errors.New("duplicate genre")
+)
+
+// Genre is a canonical genre name, along with the alternative spellings which resolve
+// to it and the number of (live) movies tagged with it.
+type Genre struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Aliases    []string `json:"aliases"`
+	MovieCount int      `json:"movie_count"`
+}
+
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+	v.Check(strings.TrimSpace(genre.Name) != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	for _, alias := range genre.Aliases {
+		v.Check(strings.TrimSpace(alias) != "", "aliases", "must not contain empty aliases")
+		v.Check(len(alias) <= 100, "aliases", "must not contain aliases more than 100 bytes long")
+	}
+}
+
+// CanonicalizeGenres maps each of the given genres onto its canonical name using the
+// lookup returned by GenreModel.CanonicalNames. Genres which don't resolve are reported
+// in the validator. A nil slice is passed straight through, so that ValidateMovie can
+// still tell that the genres weren't provided.
+func CanonicalizeGenres(v *validator.Validator, genres []string, canonical map[string]string) []string {
+	if genres == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(genres))
+	var unknown []string
+
+	for _, genre := range genres {
+		name, ok := canonical[strings.ToLower(genre)]
+		if !ok {
+			unknown = append(unknown, genre)
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	v.Check(len(unknown) == 0, "genres", "contains unknown genres: "+strings.Join(unknown, ", "))
+
+	return names
+}
+
+type GenreModel struct {
+	DB *sql.DB
+}
+
+// CanonicalNames looks up the canonical name for each of the given genre names or
+// aliases, matching them case-insensitively. The result is keyed by the lower-cased
+// input, and names which don't match any genre are left out of it.
+func (m GenreModel) CanonicalNames(names []string) (map[string]string, error) {
+	lowered := make([]string, len(names))
+	for i := range names {
+		lowered[i] = strings.ToLower(names[i])
+	}
+
+	query := `
+		SELECT genre_aliases.alias, genres.name
+		FROM genre_aliases
+		INNER JOIN genres ON genres.id = genre_aliases.genre_id
+		WHERE genre_aliases.alias = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(lowered))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	canonical := make(map[string]string)
+
+	for rows.Next() {
+		var alias, name string
+		if err := rows.Scan(&alias, &name); err != nil {
+			return nil, err
+		}
+		canonical[alias] = name
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return canonical, nil
+}
+
+// GetAll returns every genre in name order, with its aliases and movie count.
+func (m GenreModel) GetAll() ([]*Genre, error) {
+	return m.query("")
+}
+
+// Get returns a single genre.
+func (m GenreModel) Get(id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	genres, err := m.query(`WHERE g.id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(genres) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return genres[0], nil
+}
+
+func (m GenreModel) query(where string, args ...any) ([]*Genre, error) {
+	// The aliases exclude the genre's own name, which is stored alongside them so
+	// that a single lookup resolves both.
+	query := `
+		SELECT g.id, g.name,
+			ARRAY(SELECT alias FROM genre_aliases WHERE genre_id = g.id AND alias <> lower(g.name) ORDER BY alias),
+			(SELECT count(*) FROM movies WHERE movies.genres @> ARRAY[g.name] AND movies.deleted_at IS NULL)
+		FROM genres g
+		` + where + `
+		ORDER BY g.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+
+	for rows.Next() {
+		var genre Genre
+
+		err := rows.Scan(&genre.ID, &genre.Name, pq.Array(&genre.Aliases), &genre.MovieCount)
+		if err != nil {
+			return nil, err
+		}
+
+		genres = append(genres, &genre)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+// Insert creates a new genre along with its aliases. If its name or any of its aliases
+// already resolve to a genre an ErrDuplicateGenre error is returned.
+func (m GenreModel) Insert(genre *Genre) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO genres (name)
+		VALUES ($1)
+		RETURNING id`
+
+	if err := tx.QueryRowContext(ctx, query, genre.Name).Scan(&genre.ID); err != nil {
+		return err
+	}
+
+	for _, alias := range append([]string{genre.Name}, genre.Aliases...) {
+		if err := addGenreAlias(ctx, tx, genre.ID, alias); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Rename changes the canonical name of a genre and rewrites every movie tagged with the
+// old name, recording a new revision of each against userID. The old name is kept as
+// an alias so that clients which still send it keep working.
+func (m GenreModel) Rename(id int64, name string, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldName string
+
+	err = tx.QueryRowContext(ctx, `SELECT name FROM genres WHERE id = $1 FOR UPDATE`, id).Scan(&oldName)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE genres SET name = $1 WHERE id = $2`, name, id); err != nil {
+		return err
+	}
+
+	if err := addGenreAlias(ctx, tx, id, name); err != nil {
+		return err
+	}
+
+	if err := rewriteMovieGenres(ctx, tx, `array_replace(genres, $1, $2)`, oldName, name, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Merge folds the source genre into the target: movies tagged with the source are
+// retagged with the target (without duplicating it), the source's aliases move over to
+// the target, and the source genre is deleted.
+func (m GenreModel) Merge(sourceID, targetID int64, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var sourceName, targetName string
+
+	query := `SELECT name FROM genres WHERE id = $1 FOR UPDATE`
+
+	for _, lookup := range []struct {
+		id   int64
+		name *string
+	}{{sourceID, &sourceName}, {targetID, &targetName}} {
+		if err := tx.QueryRowContext(ctx, query, lookup.id).Scan(lookup.name); err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+	}
+
+	expression := `CASE WHEN genres @> ARRAY[$2::text] THEN array_remove(genres, $1) ELSE array_replace(genres, $1, $2) END`
+	if err := rewriteMovieGenres(ctx, tx, expression, sourceName, targetName, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE genre_aliases SET genre_id = $1 WHERE genre_id = $2`, targetID, sourceID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM genres WHERE id = $1`, sourceID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// addGenreAlias makes the alias resolve to the genre. Adding an alias the genre already
+// has is a no-op, but one that belongs to another genre is an ErrDuplicateGenre.
+func addGenreAlias(ctx context.Context, tx *sql.Tx, genreID int64, alias string) error {
+	var ownerID int64
+
+	err := tx.QueryRowContext(ctx, `SELECT genre_id FROM genre_aliases WHERE alias = lower($1)`, alias).Scan(&ownerID)
+	switch {
+	case err == nil && ownerID == genreID:
+		return nil
+	case err == nil:
+		return ErrDuplicateGenre
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO genre_aliases (alias, genre_id) VALUES (lower($1), $2)`, alias, genreID)
+	return err
+}
+
+// rewriteMovieGenres replaces the genres of every movie tagged with oldName using the
+// given SQL expression, in which $1 is oldName and $2 is newName. Each rewritten movie
+// gets a new version, and that version is recorded in its revision history.
+func rewriteMovieGenres(ctx context.Context, tx *sql.Tx, expression, oldName, newName string, userID int64) error {
+	query := `
+		WITH updated AS (
+			UPDATE movies
+			SET genres = ` + expression + `, version = version + 1
+			WHERE genres @> ARRAY[$1::text]
+			RETURNING id, version, title, year, runtime, genres
+		)
+		INSERT INTO movie_revisions (movie_id, version, user_id, title, year, runtime, genres)
+		SELECT id, version, $3, title, year, runtime, genres FROM updated`
+
+	_, err := tx.ExecContext(ctx, query, oldName, newName, userID)
+	return err
+}
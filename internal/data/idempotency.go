@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// IdempotencyRecord holds the response to a request made with an Idempotency-Key
+// header, so that it can be replayed if the client retries. The scope identifies the
+// endpoint and the client, so that keys only need to be unique for each of them. A
+// Status of zero means the first request is still being processed.
+type IdempotencyRecord struct {
+	Scope       string
+	Key         string
+	RequestHash []byte
+	Status      int
+	Header      map[string][]string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// Reserve claims a key for a new request, which is recorded as pending until Complete
+// is called. If the key has already been used, and hasn't expired, the existing record
+// is returned instead and reserved is false.
+func (m IdempotencyModel) Reserve(record *IdempotencyRecord) (existing *IdempotencyRecord, reserved bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// An expired key is free to be used again.
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND key = $2 AND expires_at < NOW()`
+
+	if _, err := m.DB.ExecContext(ctx, query, record.Scope, record.Key); err != nil {
+		return nil, false, err
+	}
+
+	query = `
+		INSERT INTO idempotency_keys (scope, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (scope, key) DO NOTHING`
+
+	result, err := m.DB.ExecContext(ctx, query, record.Scope, record.Key, record.RequestHash, record.ExpiresAt)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if rowsAffected == 1 {
+		return nil, true, nil
+	}
+
+	query = `
+		SELECT scope, key, request_hash, status, header, body, expires_at
+		FROM idempotency_keys
+		WHERE scope = $1 AND key = $2`
+
+	var (
+		stored IdempotencyRecord
+		header []byte
+	)
+
+	err = m.DB.QueryRowContext(ctx, query, record.Scope, record.Key).Scan(
+		&stored.Scope,
+		&stored.Key,
+		&stored.RequestHash,
+		&stored.Status,
+		&header,
+		&stored.Body,
+		&stored.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		// The record was released between our insert and this query, so there's
+		// nothing to replay, but the key isn't ours either.
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, false, ErrEditConflict
+		default:
+			return nil, false, err
+		}
+	}
+
+	if err := json.Unmarshal(header, &stored.Header); err != nil {
+		return nil, false, err
+	}
+
+	return &stored, false, nil
+}
+
+// Complete stores the response to a reserved request.
+func (m IdempotencyModel) Complete(record *IdempotencyRecord) error {
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE idempotency_keys
+		SET status = $1, header = $2, body = $3
+		WHERE scope = $4 AND key = $5`
+
+	args := []any{record.Status, header, record.Body, record.Scope, record.Key}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Release gives up a reserved key without storing a response, so that the request can
+// be retried.
+func (m IdempotencyModel) Release(scope, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key)
+	return err
+}
+
+// DeleteExpired removes the records whose time to live has passed, returning how many
+// were removed.
+func (m IdempotencyModel) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
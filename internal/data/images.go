@@ -0,0 +1,197 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/images"
+	"github.com/lib/pq"
+)
+
+// MovieImage is a poster or still uploaded for a movie. The files themselves live in
+// storage, under keys derived from the movie and image IDs, so only their metadata is
+// kept in the database. URL and Thumbnails are filled in by the handlers, which know
+// where storage serves files from.
+type MovieImage struct {
+	ID          int64             `json:"id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	MovieID     int64             `json:"-"`
+	Kind        string            `json:"kind"`
+	ContentType string            `json:"content_type"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	URL         string            `json:"url"`
+	Thumbnails  map[string]string `json:"thumbnails"`
+}
+
+// Key returns the storage key of the original image.
+func (i *MovieImage) Key() string {
+	return fmt.Sprintf("movies/%d/images/%d/original.%s", i.MovieID, i.ID, images.ContentTypes[i.ContentType])
+}
+
+// ThumbnailKey returns the storage key of one of the image's thumbnails.
+func (i *MovieImage) ThumbnailKey(name string) string {
+	return fmt.Sprintf("movies/%d/images/%d/%s.jpg", i.MovieID, i.ID, name)
+}
+
+type MovieImageModel struct {
+	DB *sql.DB
+}
+
+// Insert records a new image and then calls store to save its files, which need the
+// ID assigned by the database for their keys. If store fails the record is rolled
+// back, so there's never a row pointing at missing files.
+func (m MovieImageModel) Insert(image *MovieImage, store func(image *MovieImage) error) error {
+	query := `
+		INSERT INTO movie_images (movie_id, kind, content_type, width, height)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []any{image.MovieID, image.Kind, image.ContentType, image.Width, image.Height}
+
+	// Generating thumbnails and writing the files takes longer than a query, so this
+	// transaction gets a more generous timeout than usual.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&image.ID, &image.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := store(image); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m MovieImageModel) Get(movieID, id int64) (*MovieImage, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, movie_id, kind, content_type, width, height
+		FROM movie_images
+		WHERE movie_id = $1 AND id = $2`
+
+	var image MovieImage
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, id).Scan(
+		&image.ID,
+		&image.CreatedAt,
+		&image.MovieID,
+		&image.Kind,
+		&image.ContentType,
+		&image.Width,
+		&image.Height,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &image, nil
+}
+
+// GetAllForMovies returns the images of several movies at once, keyed by movie ID, so
+// that a page of movies needs a single query. Posters come before stills, and each
+// kind is in upload order.
+func (m MovieImageModel) GetAllForMovies(movieIDs []int64) (map[int64][]*MovieImage, error) {
+	query := `
+		SELECT id, created_at, movie_id, kind, content_type, width, height
+		FROM movie_images
+		WHERE movie_id = ANY($1)
+		ORDER BY movie_id, kind, id`
+
+	return m.query(query, pq.Array(movieIDs))
+}
+
+// GetAllForMoviesDeletedBefore returns the images of the movies which were moved to
+// the trash before the cutoff, keyed by movie ID. It's used to find the files to
+// remove when those movies are purged.
+func (m MovieImageModel) GetAllForMoviesDeletedBefore(cutoff time.Time) (map[int64][]*MovieImage, error) {
+	query := `
+		SELECT i.id, i.created_at, i.movie_id, i.kind, i.content_type, i.width, i.height
+		FROM movie_images i
+		JOIN movies m ON m.id = i.movie_id
+		WHERE m.deleted_at < $1
+		ORDER BY i.movie_id, i.kind, i.id`
+
+	return m.query(query, cutoff)
+}
+
+func (m MovieImageModel) query(query string, args ...any) (map[int64][]*MovieImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int64][]*MovieImage)
+
+	for rows.Next() {
+		var image MovieImage
+
+		err := rows.Scan(
+			&image.ID,
+			&image.CreatedAt,
+			&image.MovieID,
+			&image.Kind,
+			&image.ContentType,
+			&image.Width,
+			&image.Height,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result[image.MovieID] = append(result[image.MovieID], &image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (m MovieImageModel) Delete(image *MovieImage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM movie_images WHERE id = $1`, image.ID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
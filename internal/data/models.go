@@ -16,6 +16,15 @@ var (
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
 	Movies      MovieModel
+	Revisions   MovieRevisionModel
+	Genres      GenreModel
+	Reviews     ReviewModel
+	Watchlists  WatchlistModel
+	People      PersonModel
+	Credits     CreditModel
+	Images      MovieImageModel
+	Titles      MovieTitleModel
+	Idempotency IdempotencyModel
 	Users       UserModel
 	Tokens      TokenModel
 	Permissions PermissionModel
@@ -26,6 +35,15 @@ type Models struct {
 func NewModels(db *sql.DB) Models {
 	return Models{
 		Movies:      MovieModel{DB: db},
+		Revisions:   MovieRevisionModel{DB: db},
+		Genres:      GenreModel{DB: db},
+		Reviews:     ReviewModel{DB: db},
+		Watchlists:  WatchlistModel{DB: db},
+		People:      PersonModel{DB: db},
+		Credits:     CreditModel{DB: db},
+		Images:      MovieImageModel{DB: db},
+		Titles:      MovieTitleModel{DB: db},
+		Idempotency: IdempotencyModel{DB: db},
 		Users:       UserModel{DB: db},
 		Tokens:      TokenModel{DB: db},
 		Permissions: PermissionModel{DB: db},
@@ -3,9 +3,13 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/jandiralceu/greenlight/internal/validator"
 	"github.com/lib/pq"
@@ -19,6 +23,218 @@ type Movie struct {
 	Runtime   Runtime   `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres"`
 	Version   int32     `json:"version"`
+	// AverageRating and RatingCount summarise the reviews users have left for the
+	// movie. They're kept up to date by ReviewModel rather than edited directly.
+	AverageRating float32 `json:"average_rating"`
+	RatingCount   int     `json:"rating_count"`
+	// DeletedAt is set once a movie has been moved to the trash. Deleted movies are
+	// hidden from Get and GetAll until they are restored or purged.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Highlight holds the title with the search terms wrapped in <mark> tags. It's
+	// only populated by GetAll when the client asks for highlighted results.
+	Highlight string `json:"highlight,omitempty"`
+	// OriginalTitle and TitleLocale are set when Title has been swapped for a
+	// localized title, to say which one it is and what it replaced.
+	OriginalTitle string `json:"original_title,omitempty"`
+	TitleLocale   string `json:"title_locale,omitempty"`
+	// Credits is only populated when the client asks for them to be embedded.
+	Credits []*Credit `json:"credits,omitempty"`
+	// Images holds the posters and stills uploaded for the movie.
+	Images []*MovieImage `json:"images,omitempty"`
+
+	rank   float32
+	fields []string
+}
+
+// MovieFieldSafeList holds the fields which clients can pick from with a sparse
+// fieldset. Each of them is also the name of the column it's stored in.
+var MovieFieldSafeList = []string{"id", "title", "year", "runtime", "genres", "version", "average_rating", "rating_count"}
+
+// MarshalJSON leaves out the fields which weren't requested when the movie was read
+// with a sparse fieldset. Fields outside the safelist, like highlight, are untouched.
+func (m Movie) MarshalJSON() ([]byte, error) {
+	// The movie type has the same fields as Movie but none of its methods, so that
+	// marshalling it doesn't recurse back into this one.
+	type movie Movie
+
+	js, err := json.Marshal(movie(m))
+	if err != nil || len(m.fields) == 0 {
+		return js, err
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(js, &all); err != nil {
+		return nil, err
+	}
+
+	for _, field := range MovieFieldSafeList {
+		if !slices.Contains(m.fields, field) {
+			delete(all, field)
+		}
+	}
+
+	return json.Marshal(all)
+}
+
+// movieColumns returns the columns to select for a sparse fieldset. With no fields
+// requested we select everything. Otherwise id, version and the rating columns are
+// always included, since cursors and ETags rely on them, along with any extra columns
+// passed in (such as the sort column). Only names in MovieFieldSafeList make it into the result, so it's safe
+// to interpolate into SQL.
+func movieColumns(fields []string, extra ...string) []string {
+	if len(fields) == 0 {
+		return []string{"id", "created_at", "title", "year", "runtime", "genres", "version", "average_rating", "rating_count"}
+	}
+
+	columns := []string{"id", "version", "average_rating", "rating_count"}
+	for _, field := range append(slices.Clone(fields), extra...) {
+		if slices.Contains(MovieFieldSafeList, field) && !slices.Contains(columns, field) {
+			columns = append(columns, field)
+		}
+	}
+
+	return columns
+}
+
+// scanTargets returns the destinations to scan the given columns into.
+func (m *Movie) scanTargets(columns []string) []any {
+	targets := make([]any, len(columns))
+
+	for i, column := range columns {
+		switch column {
+		case "id":
+			targets[i] = &m.ID
+		case "created_at":
+			targets[i] = &m.CreatedAt
+		case "title":
+			targets[i] = &m.Title
+		case "year":
+			targets[i] = &m.Year
+		case "runtime":
+			targets[i] = &m.Runtime
+		case "genres":
+			targets[i] = pq.Array(&m.Genres)
+		case "version":
+			targets[i] = &m.Version
+		case "average_rating":
+			targets[i] = &m.AverageRating
+		case "rating_count":
+			targets[i] = &m.RatingCount
+		default:
+			panic("unknown movie column: " + column)
+		}
+	}
+
+	return targets
+}
+
+func ValidateMovieFields(v *validator.Validator, fields []string) {
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, MovieFieldSafeList...), "fields", "invalid field "+field)
+	}
+
+	v.Check(validator.Unique(fields), "fields", "must not contain duplicate fields")
+}
+
+// MovieSearch holds the movie-specific criteria accepted by GetAll, alongside the
+// generic paging and sorting Filters.
+type MovieSearch struct {
+	Title      string
+	Genres     []string
+	GenreMode  string
+	YearMin    int
+	YearMax    int
+	RuntimeMin Runtime
+	RuntimeMax Runtime
+	Highlight  bool
+	// Person restricts the results to movies crediting the person with this ID.
+	Person int64
+	// Deleted selects the movies in the trash instead of the live ones.
+	Deleted bool
+	// Fields is the sparse fieldset to return. It's empty for every field.
+	Fields []string
+}
+
+// conditions returns the WHERE clause matching the search criteria, along with the
+// values for its placeholders, which always start at $1 (the title query). A zero
+// value for any of the range bounds means that bound isn't applied.
+func (s MovieSearch) conditions() (string, []any) {
+	// GenreMode has been checked against the safelist by ValidateMovieSearch, so we
+	// pick the matching array operator here rather than branching inside the SQL,
+	// which keeps movies_genres_idx usable.
+	genres := "genres @> $2"
+	switch s.GenreMode {
+	case "any":
+		genres = "genres && $2"
+	case "none":
+		genres = "NOT (genres && $2)"
+	}
+
+	deleted := "deleted_at IS NULL"
+	if s.Deleted {
+		deleted = "deleted_at IS NOT NULL"
+	}
+
+	clause := fmt.Sprintf(`
+		WHERE (
+			to_tsvector('simple', title) @@ to_tsquery('simple', $1)
+			OR id IN (SELECT t.movie_id FROM movie_titles t WHERE to_tsvector('simple', t.title) @@ to_tsquery('simple', $1))
+			OR $1 = ''
+		)
+		AND (%s OR $2 = '{}')
+		AND (year >= $3 OR $3 = 0)
+		AND (year <= $4 OR $4 = 0)
+		AND (runtime >= $5 OR $5 = 0)
+		AND (runtime <= $6 OR $6 = 0)
+		AND (id IN (SELECT movie_id FROM credits WHERE person_id = $7) OR $7 = 0)
+		AND %s`, genres, deleted)
+
+	args := []any{titleQuery(s.Title), pq.Array(s.Genres), s.YearMin, s.YearMax, s.RuntimeMin, s.RuntimeMax, s.Person}
+
+	return clause, args
+}
+
+func ValidateMovieSearch(v *validator.Validator, s MovieSearch) {
+	v.Check(validator.PermittedValue(s.GenreMode, "all", "any", "none"), "genre_mode", "must be one of all, any or none")
+
+	v.Check(s.YearMin >= 0, "year_min", "must not be negative")
+	v.Check(s.YearMax >= 0, "year_max", "must not be negative")
+	v.Check(s.YearMax == 0 || s.YearMin <= s.YearMax, "year_min", "must not be greater than year_max")
+
+	v.Check(s.RuntimeMin >= 0, "runtime_min", "must not be negative")
+	v.Check(s.RuntimeMax >= 0, "runtime_max", "must not be negative")
+	v.Check(s.RuntimeMax == 0 || s.RuntimeMin <= s.RuntimeMax, "runtime_min", "must not be greater than runtime_max")
+
+	v.Check(s.Person >= 0, "person", "must not be negative")
+
+	ValidateMovieFields(v, s.Fields)
+}
+
+// movieRankExpression scores how well a movie title matches the search query in $1,
+// taking the best score of the original and localized titles. It short-circuits to
+// zero when there is no search term, which also spares us the notice Postgres raises
+// for an empty tsquery.
+const movieRankExpression = `CASE WHEN $1 = '' THEN 0 ELSE GREATEST(
+	ts_rank_cd(to_tsvector('simple', title), to_tsquery('simple', $1)),
+	(SELECT max(ts_rank_cd(to_tsvector('simple', t.title), to_tsquery('simple', $1))) FROM movie_titles t WHERE t.movie_id = movies.id)
+) END`
+
+// titleQuery turns free text typed by the client into a to_tsquery() expression. Each
+// word must match, and the last one is treated as a prefix so that "star" also finds
+// "Starship" while the user is still typing. Anything other than letters and digits is
+// dropped, so the result is always valid tsquery syntax.
+func titleQuery(title string) string {
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) == 0 {
+		return ""
+	}
+
+	words[len(words)-1] += ":*"
+
+	return strings.Join(words, " & ")
 }
 
 // MovieModel Define a MovieModel struct type which wraps a sql.DB connection pool.
@@ -26,8 +242,48 @@ type MovieModel struct {
 	DB *sql.DB
 }
 
-// Insert Add a placeholder method for inserting a new record in the movies table.
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert Add a placeholder method for inserting a new record in the movies table. The
+// first revision of the movie is recorded against userID in the same transaction.
+func (m MovieModel) Insert(movie *Movie, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertMovie(ctx, tx, movie, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertBatch inserts all of the movies in a single transaction, so that either every
+// one of them is saved or none are.
+func (m MovieModel) InsertBatch(movies []*Movie, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, movie := range movies {
+		if err := insertMovie(ctx, tx, movie, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertMovie inserts a movie and its first revision as part of the transaction tx.
+func insertMovie(ctx context.Context, tx *sql.Tx, movie *Movie, userID int64) error {
 	// Define the SQL query for inserting a new record in
 	// the system-generated data.
 	query := `
@@ -40,38 +296,89 @@ func (m MovieModel) Insert(movie *Movie) error {
 	// make it nice and clear *what values are being used where* in the query.
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	// Use the QueryRow() method to execute the SQL query in the transaction, passing
+	// in the args slice as a variadic parameter and scanning the system-generated id,
+	// created_at and version values into the movie struct.
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version); err != nil {
+		return err
+	}
 
-	// Use the QueryRow() method to execute the SQL query on our connection pool,
-	// passing in the args slice as a variadic parameter and scanning the system-
-	// generated id, created_at and version values into the movie struct.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return insertMovieRevision(ctx, tx, movie, userID)
 }
 
 // GetAll Create a new  method which returns a slice of movies. Although we're not
 // using them right now, we've set this up to accept the various filter parameters as
 // arguments.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(search MovieSearch, filters Filters) ([]*Movie, Metadata, error) {
+	column, direction := filters.sortColumn(), filters.sortDirection()
+	title := titleQuery(search.Title)
+
+	// Highlighting is only worth the ts_headline() call when there is something to
+	// highlight.
+	highlight := "''"
+	if search.Highlight && title != "" {
+		highlight = `ts_headline('simple', title, to_tsquery('simple', $1), 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true')`
+	}
+
+	// In cursor mode we skip the count(*) OVER() window, which has to visit every
+	// matching row, and fetch one extra record so that we know if there's a next page.
+	totalColumn := "count(*) OVER()"
+	limit, offset := filters.limit(), filters.offset()
+	if filters.UseCursor {
+		totalColumn = "0"
+		limit, offset = filters.limit()+1, 0
+	}
+
+	// As our SQL query now has quite a few placeholder parameters, let's collect the
+	// values for the placeholders in a slice. Notice here how we call the limit() and
+	// offset() methods on the Filters struct to get the appropriate values for the
+	// LIMIT and OFFSET clauses.
+	where, args := search.conditions()
+	args = append(args, limit, offset)
+	limitArg := len(args) - 1
+
+	var c cursor
+	idDirection := "ASC"
+	keyset := ""
+
+	if filters.UseCursor && filters.Cursor != "" {
+		var err error
+		if c, err = decodeCursor(filters.Cursor); err != nil || c.Sort != filters.Sort {
+			return nil, Metadata{}, ErrInvalidCursor
+		}
+
+		value, err := movieCursorValue(column, c.Value)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		keyset = keysetCondition(movieSortExpression(column), direction, c.Backward, len(args)+1, len(args)+2)
+		args = append(args, value, c.ID)
+
+		// Walking backwards means reading the rows in the opposite order and then
+		// reversing them once they've been scanned.
+		if c.Backward {
+			direction, idDirection = reverseDirection(direction), "DESC"
+		}
+	}
+
+	// Only select the columns for the requested fields, plus the sort column which
+	// we need to build cursors.
+	columns := movieColumns(search.Fields, movieSortExpression(column))
+
 	// Construct the SQL query to retrieve all movie records.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		SELECT %s, %s, deleted_at, %s, %s
 		FROM movies
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-		AND (genres @> $2 OR $2 = '{}')
-		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+		%s
+		%s
+		ORDER BY %s %s, id %s
+		LIMIT $%d OFFSET $%d`, totalColumn, strings.Join(columns, ", "), movieRankExpression, highlight, where, keyset, movieSortExpression(column), direction, idDirection, limitArg, limitArg+1)
 
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// As our SQL query now has quite a few placeholder parameters, let's collect the
-	// values for the placeholders in a slice. Notice here how we call the limit() and
-	// offset() methods on the Filters struct to get the appropriate values for the
-	// LIMIT and OFFSET clauses.
-	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
-
 	// Use QueryContext() to execute the query. This returns a sql.Rows resultset
 	// containing the result.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
@@ -90,20 +397,15 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// Use rows.Next to iterate through the rows in the resultset.
 	for rows.Next() {
 		// Initialize an empty Movie struct to hold the data for an individual movie.
-		var movie Movie
+		movie := Movie{fields: search.Fields}
 
-		// Scan the values from the row into the Movie struct. Again, note that we're
-		// using the pq.Array() adapter on the genres field here.
-		err := rows.Scan(
-			&totalRecords,
-			&movie.ID,
-			&movie.CreatedAt,
-			&movie.Title,
-			&movie.Year,
-			&movie.Runtime,
-			pq.Array(&movie.Genres),
-			&movie.Version,
-		)
+		// Scan the values from the row into the Movie struct. The scan targets for the
+		// selected columns take care of using the pq.Array() adapter on genres.
+		targets := []any{&totalRecords}
+		targets = append(targets, movie.scanTargets(columns)...)
+		targets = append(targets, &movie.DeletedAt, &movie.rank, &movie.Highlight)
+
+		err := rows.Scan(targets...)
 
 		if err != nil {
 			return nil, Metadata{}, err
@@ -119,14 +421,187 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		return nil, Metadata{}, err
 	}
 
+	if filters.UseCursor {
+		movies, metadata := cursorPage(movies, column, filters, c)
+		return movies, metadata, nil
+	}
+
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
 
 	// If everything went OK, then return the slice of movies.
 	return movies, metadata, nil
 }
 
+// cursorPage trims the extra look-ahead row fetched in cursor mode, restores the
+// natural order of a backwards page and builds the next/prev cursors around it.
+func cursorPage(movies []*Movie, column string, filters Filters, c cursor) ([]*Movie, Metadata) {
+	hasMore := len(movies) > filters.limit()
+	if hasMore {
+		movies = movies[:filters.limit()]
+	}
+
+	if c.Backward {
+		slices.Reverse(movies)
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+	if len(movies) == 0 {
+		return movies, metadata
+	}
+
+	// Going forwards there is a next page only if we saw the look-ahead row, and a
+	// previous page whenever we started from a cursor. Going backwards it's the
+	// other way round, and the page we came from is always there.
+	if hasMore || c.Backward {
+		last := movies[len(movies)-1]
+		metadata.NextCursor = encodeCursor(cursor{Sort: filters.Sort, Value: movieSortValue(last, column), ID: last.ID})
+	}
+
+	if (hasMore && c.Backward) || (!c.Backward && filters.Cursor != "") {
+		first := movies[0]
+		metadata.PrevCursor = encodeCursor(cursor{Sort: filters.Sort, Value: movieSortValue(first, column), ID: first.ID, Backward: true})
+	}
+
+	return movies, metadata
+}
+
+// keysetCondition returns the WHERE fragment which selects the rows after (or, when
+// backward is true, before) the cursor row, given the sort column and direction. The
+// id is always the tie-breaker, in ascending order, just like in the ORDER BY clause.
+func keysetCondition(column, direction string, backward bool, valueArg, idArg int) string {
+	columnOp, idOp := ">", ">"
+	if (direction == "DESC") != backward {
+		columnOp = "<"
+	}
+
+	if backward {
+		idOp = "<"
+	}
+
+	return fmt.Sprintf("AND (%[1]s %[2]s $%[4]d OR (%[1]s = $%[4]d AND id %[3]s $%[5]d))", column, columnOp, idOp, valueArg, idArg)
+}
+
+// movieSortExpression maps a sort column onto the SQL expression used to order by it.
+// Relevance is the negated search rank, so that the natural ascending order of
+// sort=relevance puts the best matches first, and rating is the average review rating.
+func movieSortExpression(column string) string {
+	switch column {
+	case "relevance":
+		return "-(" + movieRankExpression + ")"
+	case "rating":
+		return "average_rating"
+	}
+
+	return column
+}
+
+func reverseDirection(direction string) string {
+	if direction == "DESC" {
+		return "ASC"
+	}
+
+	return "DESC"
+}
+
+// movieSortValue returns the JSON-encoded value of the given sort column for a movie,
+// ready to be embedded in a cursor.
+func movieSortValue(movie *Movie, column string) json.RawMessage {
+	var value any
+
+	switch column {
+	case "title":
+		value = movie.Title
+	case "year":
+		value = movie.Year
+	case "runtime":
+		value = int32(movie.Runtime)
+	case "relevance":
+		value = -movie.rank
+	case "rating":
+		value = movie.AverageRating
+	default:
+		value = movie.ID
+	}
+
+	js, err := json.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return js
+}
+
+// movieCursorValue decodes the sort column value carried in a cursor, making sure
+// that it has the right type for the column so a tampered cursor can't reach the
+// database as a malformed parameter.
+func movieCursorValue(column string, raw json.RawMessage) (any, error) {
+	switch column {
+	case "title":
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return s, nil
+	case "relevance", "rating":
+		var f float32
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return f, nil
+	default:
+		var i int64
+		if err := json.Unmarshal(raw, &i); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		return i, nil
+	}
+}
+
+// Export streams every movie matching the search to fn, in the order given by the
+// filters' sort, without loading them all into memory. Paging in filters is ignored.
+// Unlike our other queries this one can legitimately run for a long time, so it's
+// bounded by the caller's context rather than a fixed timeout. If fn returns an error
+// the export stops and that error is returned.
+func (m MovieModel) Export(ctx context.Context, search MovieSearch, filters Filters, fn func(*Movie) error) error {
+	where, args := search.conditions()
+
+	columns := movieColumns(nil)
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM movies
+		%s
+		ORDER BY %s %s, id ASC`, strings.Join(columns, ", "), where, movieSortExpression(filters.sortColumn()), filters.sortDirection())
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var movie Movie
+
+		if err := rows.Scan(movie.scanTargets(columns)...); err != nil {
+			return err
+		}
+
+		if err := fn(&movie); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
 // Get Add a placeholder method for fetching a specific record from the movies table.
 func (m MovieModel) Get(id int64) (*Movie, error) {
+	return m.GetFields(id, nil)
+}
+
+// GetFields fetches a specific movie, selecting only the columns needed for the given
+// sparse fieldset. An empty fieldset fetches every field, just like Get.
+func (m MovieModel) GetFields(id int64, fields []string) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
 	// less than that. To avoid making an unnecessary database call, we take a shortcut
@@ -135,14 +610,16 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 
+	columns := movieColumns(fields)
+
 	// Define the SQL query for retrieving the movie data.
-	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM movies
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`, strings.Join(columns, ", "))
 
 	// Declare a Movie struct to hold the data returned by the query.
-	var movie Movie
+	movie := Movie{fields: fields}
 
 	// Use the context.WithTimeout() function to create a context.Context which carries a
 	// 3-second timeout deadline. Note that we're using the empty context.Background()
@@ -155,15 +632,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Use the QueryRowContext() method to execute the query, passing in the context
 	// with the deadline as the first argument.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&movie.ID,
-		&movie.CreatedAt,
-		&movie.Title,
-		&movie.Year,
-		&movie.Runtime,
-		pq.Array(&movie.Genres),
-		&movie.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(movie.scanTargets(columns)...)
 
 	// Handle any errors. If there was no matching movie found, Scan() will return
 	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
@@ -182,13 +651,15 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Update Add a placeholder method for updating a specific record in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+// The new revision is recorded against userID in the same transaction, so the history
+// never misses a version.
+func (m MovieModel) Update(movie *Movie, userID int64) error {
 	// Declare the SQL query for updating the record and returning the new version
 	// number.
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-		WHERE id = $5 AND version = $6
+		WHERE id = $5 AND version = $6 AND deleted_at IS NULL
 		RETURNING version`
 
 	args := []any{
@@ -203,10 +674,16 @@ func (m MovieModel) Update(movie *Movie) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	/// Execute the SQL query. If no matching row could be found, we know the movie
 	// version has changed (or the record has been deleted) and we return our custom
 	// ErrEditConflict error.
-	if err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version); err != nil {
+	if err := tx.QueryRowContext(ctx, query, args...).Scan(&movie.Version); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
@@ -215,21 +692,118 @@ func (m MovieModel) Update(movie *Movie) error {
 		}
 	}
 
-	return nil
+	if err := insertMovieRevision(ctx, tx, movie, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// Delete Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+// Delete moves a movie to the trash by stamping its deleted_at time. The record stays in
+// the movies table so that it can be restored, until it's purged.
+func (m MovieModel) Delete(id int64, version int32) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
-	if id < 0 {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	// Construct the SQL query to soft-delete the record. As with Update, the version
+	// must still be the one the caller read, so that an edit made in the meantime isn't
+	// thrown away. Movies which are already in the trash are left alone.
+	query := `
+		UPDATE movies
+		SET deleted_at = NOW()
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, version)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// No rows affected means the movie was changed or deleted after the caller read
+	// it.
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Restore takes a movie back out of the trash.
+func (m MovieModel) Restore(id int64) error {
+	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	// Construct the SQL query to delete the record.
+	query := `
+		UPDATE movies
+		SET deleted_at = NULL
+		WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	return m.execForID(query, id)
+}
+
+// Purge permanently removes a movie which is in the trash. Live movies must be deleted
+// first, so that a purge can never skip the trash.
+func (m MovieModel) Purge(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM movies
+		WHERE id = $1 AND deleted_at IS NOT NULL`
+
+	return m.execForID(query, id)
+}
+
+// PurgeDeletedBefore permanently removes every movie which was moved to the trash
+// before the cutoff time, returning the IDs of the movies removed.
+func (m MovieModel) PurgeDeletedBefore(cutoff time.Time) ([]int64, error) {
 	query := `
 		DELETE FROM movies
-		WHERE id = $1`
+		WHERE deleted_at < $1
+		RETURNING id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
+	rows, err := m.DB.QueryContext(ctx, query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+
+	for rows.Next() {
+		var id int64
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// execForID executes a statement which targets a single movie by its id, returning an
+// ErrRecordNotFound error if it didn't affect any rows.
+func (m MovieModel) execForID(query string, id int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -248,9 +822,9 @@ func (m MovieModel) Delete(id int64) error {
 		return err
 	}
 
-	// If no rows were affected, we know that the movies table didn't contain a record
-	// with the provided ID at the moment we tried to delete it. In that case we
-	// return an ErrRecordNotFound error.
+	// If no rows were affected, we know that the movies table didn't contain a
+	// matching record at the moment we tried to change it. In that case we return an
+	// ErrRecordNotFound error.
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
 	}
@@ -275,3 +849,208 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate genres")
 }
+
+// MovieDuplicate is an existing movie which looks like the same film as one being
+// created or updated. Similarity is the trigram similarity of the two titles, from 0
+// to 1.
+type MovieDuplicate struct {
+	ID         int64   `json:"id"`
+	Title      string  `json:"title"`
+	Year       int32   `json:"year"`
+	Similarity float32 `json:"similarity"`
+	Link       string  `json:"link"`
+}
+
+// duplicateSimilarity is how similar two titles need to be for a movie to count as a
+// likely duplicate whatever its year.
+const duplicateSimilarity = 0.6
+
+// FindDuplicates returns the live movies which are likely duplicates of the given one:
+// those with the same title, ignoring case and punctuation, and the same year, along
+// with those whose title is very similar. The movie itself is excluded, so that it can
+// be checked when it's updated. The closest matches come first.
+func (m MovieModel) FindDuplicates(movie *Movie) ([]*MovieDuplicate, error) {
+	query := `
+		SELECT id, title, year, similarity(lower(title), lower($1))
+		FROM movies
+		WHERE deleted_at IS NULL
+		AND id <> $3
+		AND (
+			(regexp_replace(lower(title), '[^[:alnum:]]+', '', 'g') = regexp_replace(lower($1), '[^[:alnum:]]+', '', 'g') AND year = $2)
+			OR (lower(title) % lower($1) AND similarity(lower(title), lower($1)) >= $4)
+		)
+		ORDER BY year = $2 DESC, 4 DESC, id ASC
+		LIMIT 5`
+
+	args := []any{movie.Title, movie.Year, movie.ID, duplicateSimilarity}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := []*MovieDuplicate{}
+
+	for rows.Next() {
+		var duplicate MovieDuplicate
+
+		if err := rows.Scan(&duplicate.ID, &duplicate.Title, &duplicate.Year, &duplicate.Similarity); err != nil {
+			return nil, err
+		}
+
+		duplicates = append(duplicates, &duplicate)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return duplicates, nil
+}
+
+// DuplicateSet finds likely duplicates among movies which aren't in the database yet,
+// such as the items of a batch, by the same rules as FindDuplicates. The trigram
+// similarity of two titles is worked out the way pg_trgm does it.
+type DuplicateSet struct {
+	exact  map[string]int
+	titles []duplicateTitle
+}
+
+type duplicateTitle struct {
+	index    int
+	trigrams map[string]bool
+}
+
+func NewDuplicateSet() *DuplicateSet {
+	return &DuplicateSet{exact: make(map[string]int)}
+}
+
+// Add records a movie under the given index, unless it's a likely duplicate of one
+// added before, in which case that movie's index is returned and ok is true.
+func (s *DuplicateSet) Add(index int, movie *Movie) (duplicate int, ok bool) {
+	key := fmt.Sprintf("%s:%d", normalizeTitle(movie.Title), movie.Year)
+	if duplicate, ok := s.exact[key]; ok {
+		return duplicate, true
+	}
+
+	trigrams := titleTrigrams(movie.Title)
+
+	for _, title := range s.titles {
+		if trigramSimilarity(trigrams, title.trigrams) >= duplicateSimilarity {
+			return title.index, true
+		}
+	}
+
+	s.exact[key] = index
+	s.titles = append(s.titles, duplicateTitle{index: index, trigrams: trigrams})
+
+	return 0, false
+}
+
+// normalizeTitle lowercases a title and strips everything but letters and digits, like
+// the regexp_replace() in FindDuplicates.
+func normalizeTitle(title string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, title)
+}
+
+// titleTrigrams returns the set of trigrams pg_trgm extracts from a title: each word
+// is lowercased and padded with two spaces in front and one behind.
+func titleTrigrams(title string) map[string]bool {
+	trigrams := make(map[string]bool)
+
+	words := strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			trigrams[string(padded[i:i+3])] = true
+		}
+	}
+
+	return trigrams
+}
+
+func trigramSimilarity(a, b map[string]bool) float64 {
+	shared := 0
+	for trigram := range a {
+		if b[trigram] {
+			shared++
+		}
+	}
+
+	total := len(a) + len(b) - shared
+	if total == 0 {
+		return 0
+	}
+
+	return float64(shared) / float64(total)
+}
+
+// MovieSuggestion is the short form of a movie returned for title autocompletion.
+type MovieSuggestion struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Year  int32  `json:"year"`
+}
+
+// Suggest returns up to limit movies whose title matches what the user has typed so
+// far, using the same word prefix matching as the title search. Titles which start
+// with the text come first, then the best ranked and shortest ones. It has a much
+// tighter timeout than our other queries, as a late suggestion is no use to anyone.
+func (m MovieModel) Suggest(q string, limit int) ([]*MovieSuggestion, error) {
+	suggestions := []*MovieSuggestion{}
+
+	tsquery := titleQuery(q)
+	if tsquery == "" {
+		return suggestions, nil
+	}
+
+	query := `
+		SELECT id, title, year
+		FROM movies
+		WHERE to_tsvector('simple', title) @@ to_tsquery('simple', $1)
+		AND deleted_at IS NULL
+		ORDER BY lower(title) LIKE $2 DESC,
+			ts_rank_cd(to_tsvector('simple', title), to_tsquery('simple', $1)) DESC,
+			length(title), id
+		LIMIT $3`
+
+	// Escape LIKE's wildcards, so that the text is matched literally.
+	prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(strings.TrimSpace(q))) + "%"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, tsquery, prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var suggestion MovieSuggestion
+
+		if err := rows.Scan(&suggestion.ID, &suggestion.Title, &suggestion.Year); err != nil {
+			return nil, err
+		}
+
+		suggestions = append(suggestions, &suggestion)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return suggestions, nil
+}
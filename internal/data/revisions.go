@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// MovieRevision is a snapshot of a movie's fields as they were at a given version,
+// along with who saved that version and when.
+type MovieRevision struct {
+	MovieID   int64     `json:"-"`
+	Version   int32     `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    *int64    `json:"user_id"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year"`
+	Runtime   Runtime   `json:"runtime"`
+	Genres    []string  `json:"genres"`
+}
+
+// FieldChange describes how a single field differs between two revisions.
+type FieldChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// DiffMovieRevisions returns the fields which differ between two revisions, keyed by
+// their JSON name. Unchanged fields are left out.
+func DiffMovieRevisions(from, to *MovieRevision) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+
+	if from.Title != to.Title {
+		changes["title"] = FieldChange{From: from.Title, To: to.Title}
+	}
+
+	if from.Year != to.Year {
+		changes["year"] = FieldChange{From: from.Year, To: to.Year}
+	}
+
+	if from.Runtime != to.Runtime {
+		changes["runtime"] = FieldChange{From: from.Runtime, To: to.Runtime}
+	}
+
+	if !slices.Equal(from.Genres, to.Genres) {
+		changes["genres"] = FieldChange{From: from.Genres, To: to.Genres}
+	}
+
+	return changes
+}
+
+// Apply copies the fields captured in the revision onto the movie, leaving its ID
+// and Version alone so that saving it still goes through the optimistic lock.
+func (r *MovieRevision) Apply(movie *Movie) {
+	movie.Title = r.Title
+	movie.Year = r.Year
+	movie.Runtime = r.Runtime
+	movie.Genres = slices.Clone(r.Genres)
+}
+
+// insertMovieRevision records the current state of the movie as a new revision. It's
+// called from within the transaction which wrote the movie.
+func insertMovieRevision(ctx context.Context, tx *sql.Tx, movie *Movie, userID int64) error {
+	query := `
+		INSERT INTO movie_revisions (movie_id, version, user_id, title, year, runtime, genres)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []any{movie.ID, movie.Version, userID, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+type MovieRevisionModel struct {
+	DB *sql.DB
+}
+
+// GetAllForMovie returns a page of the revisions saved for a movie.
+func (m MovieRevisionModel) GetAllForMovie(movieID int64, filters Filters) ([]*MovieRevision, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), movie_id, version, created_at, user_id, title, year, runtime, genres
+		FROM movie_revisions
+		WHERE movie_id = $1
+		ORDER BY %s %s
+		LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	revisions := []*MovieRevision{}
+
+	for rows.Next() {
+		var revision MovieRevision
+
+		err := rows.Scan(
+			&totalRecords,
+			&revision.MovieID,
+			&revision.Version,
+			&revision.CreatedAt,
+			&revision.UserID,
+			&revision.Title,
+			&revision.Year,
+			&revision.Runtime,
+			pq.Array(&revision.Genres),
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return revisions, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Get returns a single revision of a movie.
+func (m MovieRevisionModel) Get(movieID int64, version int32) (*MovieRevision, error) {
+	query := `
+		SELECT movie_id, version, created_at, user_id, title, year, runtime, genres
+		FROM movie_revisions
+		WHERE movie_id = $1 AND version = $2`
+
+	var revision MovieRevision
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, version).Scan(
+		&revision.MovieID,
+		&revision.Version,
+		&revision.CreatedAt,
+		&revision.UserID,
+		&revision.Title,
+		&revision.Year,
+		&revision.Runtime,
+		pq.Array(&revision.Genres),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &revision, nil
+}
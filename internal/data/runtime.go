@@ -16,20 +16,31 @@ func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
 		return ErrInvalidRuntimeFormat
 	}
 
-	parts := strings.Split(unquotedJSONValue, " ")
+	runtime, err := ParseRuntime(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
+
+	*r = runtime
+
+	return nil
+}
+
+// ParseRuntime parses a runtime in the "<runtime> mins" format used in our JSON
+// representation, so that query string parameters can accept the same format.
+func ParseRuntime(s string) (Runtime, error) {
+	parts := strings.Split(s, " ")
 
 	if len(parts) != 2 || parts[1] != "mins" {
-		return ErrInvalidRuntimeFormat
+		return 0, ErrInvalidRuntimeFormat
 	}
 
 	i, err := strconv.ParseInt(parts[0], 10, 32)
 	if err != nil {
-		return ErrInvalidRuntimeFormat
+		return 0, ErrInvalidRuntimeFormat
 	}
 
-	*r = Runtime(i)
-
-	return nil
+	return Runtime(i), nil
 }
 
 func (r Runtime) MarshalJSON() ([]byte, error) {
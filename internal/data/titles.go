@@ -0,0 +1,198 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jandiralceu/greenlight/internal/validator"
+	"github.com/lib/pq"
+)
+
+// LocaleRX matches a BCP 47 language tag such as "fr", "pt-br" or "zh-hant-tw". Tags
+// are stored and compared in lower case.
+var LocaleRX = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// MovieTitle is the title a movie is known by in a particular locale.
+type MovieTitle struct {
+	MovieID int64  `json:"-"`
+	Locale  string `json:"locale"`
+	Title   string `json:"title"`
+}
+
+func ValidateLocale(v *validator.Validator, key, locale string) {
+	v.Check(locale != "", key, "must be provided")
+	v.Check(len(locale) <= 35, key, "must not be more than 35 bytes long")
+	v.Check(validator.Matches(locale, LocaleRX), key, "must be a valid language tag")
+}
+
+func ValidateMovieTitle(v *validator.Validator, title *MovieTitle) {
+	ValidateLocale(v, "locale", title.Locale)
+
+	v.Check(title.Title != "", "title", "must be provided")
+	v.Check(len(title.Title) <= 500, "title", "must not be more than 500 bytes long")
+}
+
+type MovieTitleModel struct {
+	DB *sql.DB
+}
+
+func (m MovieTitleModel) GetAllForMovie(movieID int64) ([]*MovieTitle, error) {
+	query := `
+		SELECT movie_id, locale, title
+		FROM movie_titles
+		WHERE movie_id = $1
+		ORDER BY locale`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	titles := []*MovieTitle{}
+
+	for rows.Next() {
+		var title MovieTitle
+
+		if err := rows.Scan(&title.MovieID, &title.Locale, &title.Title); err != nil {
+			return nil, err
+		}
+
+		titles = append(titles, &title)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return titles, nil
+}
+
+// Upsert sets the title of a movie in a locale, replacing any title it already had
+// there.
+func (m MovieTitleModel) Upsert(title *MovieTitle) error {
+	query := `
+		INSERT INTO movie_titles (movie_id, locale, title)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (movie_id, locale) DO UPDATE SET title = EXCLUDED.title`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, title.MovieID, title.Locale, title.Title)
+	return err
+}
+
+func (m MovieTitleModel) Delete(movieID int64, locale string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM movie_titles WHERE movie_id = $1 AND locale = $2`, movieID, locale)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Localize swaps the title of each movie for its title in the first of the locales,
+// in order of preference, that it has one for. Movies with none of them keep their
+// original title.
+func (m MovieTitleModel) Localize(movies []*Movie, locales []string) error {
+	if len(movies) == 0 || len(locales) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+
+	query := `
+		SELECT movie_id, locale, title
+		FROM movie_titles
+		WHERE movie_id = ANY($1) AND locale = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids), pq.Array(locales))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	titles := make(map[int64]map[string]string)
+
+	for rows.Next() {
+		var title MovieTitle
+
+		if err := rows.Scan(&title.MovieID, &title.Locale, &title.Title); err != nil {
+			return err
+		}
+
+		if titles[title.MovieID] == nil {
+			titles[title.MovieID] = make(map[string]string)
+		}
+		titles[title.MovieID][title.Locale] = title.Title
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, movie := range movies {
+		for _, locale := range locales {
+			if title, ok := titles[movie.ID][locale]; ok {
+				movie.OriginalTitle, movie.Title, movie.TitleLocale = movie.Title, title, locale
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// LocaleFallbacks expands a list of language tags, in order of preference, with the
+// less specific tags each one falls back to, so that "pt-br" is followed by "pt". Tags
+// are lower-cased and duplicates dropped.
+func LocaleFallbacks(tags []string) []string {
+	var locales []string
+
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+
+		for tag != "" {
+			if !LocaleRX.MatchString(tag) {
+				break
+			}
+
+			if !validator.PermittedValue(tag, locales...) {
+				locales = append(locales, tag)
+			}
+
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+
+	return locales
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/jandiralceu/greenlight/internal/validator"
@@ -14,14 +15,43 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeEmailChange    = "email_change"
+	ScopePasswordReset  = "password_reset"
+	ScopeRefresh        = "refresh"
 )
 
+// ErrTokenReused is returned when a refresh token which has already been exchanged is
+// presented again.
+var ErrTokenReused = errors.New("token reused")
+
 type Token struct {
+	ID        int64     `json:"-"`
 	PlainText string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// Email is the address an email_change token will move the user to once it has
+	// been confirmed. It is empty for the other scopes.
+	Email string `json:"-"`
+	// IP and UserAgent describe the client an authentication token was issued to.
+	IP        string `json:"-"`
+	UserAgent string `json:"-"`
+	// Family is shared by the authentication and refresh tokens which descend from
+	// the same login, so that they can all be revoked together.
+	Family string `json:"-"`
+}
+
+// Session describes an authentication token to its owner, without giving away the
+// token itself.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -62,12 +92,158 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
+// NewSession logs a client in, creating a short-lived authentication token and the
+// refresh token which can later be exchanged for a new pair. Both start a new family.
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, ip, userAgent string) (*Token, *Token, error) {
+	randomBytes := make([]byte, 16)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return nil, nil, err
+	}
+
+	family := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err := insertSession(ctx, tx, userID, family, accessTTL, refreshTTL, ip, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// Rotate exchanges a refresh token for a new authentication and refresh token in the
+// same family, revoking the family's previous authentication token. A refresh token
+// can only be exchanged once: if a used one comes back, somebody other than its owner
+// may hold a copy, so the whole family is revoked and ErrTokenReused is returned.
+func (m TokenModel) Rotate(tokenPlainText string, accessTTL, refreshTTL time.Duration, ip, userAgent string) (*Token, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT user_id, family, expiry, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2
+		FOR UPDATE`
+
+	var (
+		userID int64
+		family string
+		expiry time.Time
+		usedAt *time.Time
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &family, &expiry, &usedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if !expiry.After(time.Now()) {
+		return nil, nil, ErrRecordNotFound
+	}
+
+	if usedAt != nil {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family); err != nil {
+			return nil, nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, nil, err
+		}
+
+		return nil, nil, ErrTokenReused
+	}
+
+	// The used token is kept until it expires, so that a replay of it can be noticed.
+	if _, err := tx.ExecContext(ctx, `UPDATE tokens SET used_at = NOW() WHERE hash = $1`, tokenHash[:]); err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, family, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertSession(ctx, tx, userID, family, accessTTL, refreshTTL, ip, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, tx.Commit()
+}
+
+// insertSession creates an authentication and refresh token pair in the given family.
+func insertSession(ctx context.Context, tx *sql.Tx, userID int64, family string, accessTTL, refreshTTL time.Duration, ip, userAgent string) (*Token, *Token, error) {
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`
+
+	for _, token := range []*Token{access, refresh} {
+		token.IP = ip
+		token.UserAgent = userAgent
+		token.Family = family
+
+		args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.IP, token.UserAgent, token.Family}
+
+		if err := tx.QueryRowContext(ctx, query, args...).Scan(&token.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, nil
+}
+
+// NewEmailChange creates an email_change token which, once confirmed, moves the user
+// to the given email address.
+func (m TokenModel) NewEmailChange(userID int64, ttl time.Duration, email string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Email = email
+
+	err = m.Insert(token)
+	return token, err
+}
+
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (hash, user_id, expiry, scope, email, ip, user_agent)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Email, token.IP, token.UserAgent}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -87,3 +263,150 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// GetAllSessionsForUser returns the user's unexpired authentication tokens, most
+// recently created first.
+func (m TokenModel) GetAllSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT id, created_at, expiry, last_used_at, ip, user_agent
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY created_at DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.Expiry,
+			&session.LastUsedAt,
+			&session.IP,
+			&session.UserAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records that an authentication token has just been used, and by which
+// client.
+func (m TokenModel) TouchSession(id int64, ip, userAgent string) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW(), ip = $2, user_agent = $3
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id, ip, userAgent)
+	return err
+}
+
+// DeleteSession revokes one of the user's authentication tokens, along with the rest
+// of its family so that it can't be brought back with a refresh token.
+func (m TokenModel) DeleteSession(userID int64, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2 AND (
+			(id = $1 AND scope = $3) OR
+			family = (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $3)
+		)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RevokedToken records an authentication token which was deleted before it expired.
+type RevokedToken struct {
+	Hash      []byte
+	Expiry    time.Time
+	RevokedAt time.Time
+}
+
+// GetRevokedSince returns the unexpired authentication tokens revoked at or after the
+// given time.
+func (m TokenModel) GetRevokedSince(since time.Time) ([]*RevokedToken, error) {
+	query := `
+		SELECT hash, expiry, revoked_at
+		FROM revoked_tokens
+		WHERE revoked_at >= $1 AND expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := []*RevokedToken{}
+
+	for rows.Next() {
+		var token RevokedToken
+
+		if err := rows.Scan(&token.Hash, &token.Expiry, &token.RevokedAt); err != nil {
+			return nil, err
+		}
+
+		revoked = append(revoked, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return revoked, nil
+}
+
+// DeleteExpiredRevocations forgets revoked tokens which would have expired by now
+// anyway, returning how many were removed.
+func (m TokenModel) DeleteExpiredRevocations() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expiry < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,294 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicateWatchlistEntry = errors.New("duplicate watchlist entry")
+)
+
+// WatchlistEntry is a movie on a user's watchlist. Entries are kept in the order the
+// user chooses, with Position counting up from 1.
+//
+// Purging a movie removes it from every watchlist. While a movie is in the trash its
+// entries are kept but hidden, so restoring the movie puts it back where it was. The
+// stored positions still count hidden entries, so Position is the entry's place among
+// the visible ones rather than the stored value.
+type WatchlistEntry struct {
+	UserID    int64      `json:"-"`
+	MovieID   int64      `json:"-"`
+	Movie     *Movie     `json:"movie"`
+	Position  int        `json:"position"`
+	Watched   bool       `json:"watched"`
+	WatchedAt *time.Time `json:"watched_at,omitempty"`
+	AddedAt   time.Time  `json:"added_at"`
+}
+
+type WatchlistModel struct {
+	DB *sql.DB
+}
+
+// watchlistColumns is the select list used to read an entry along with its movie.
+func watchlistColumns() string {
+	columns := []string{"w.user_id", "w.movie_id", "w.position", "w.watched", "w.watched_at", "w.added_at"}
+	for _, column := range movieColumns(nil) {
+		columns = append(columns, "m."+column)
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+func (e *WatchlistEntry) scanTargets() []any {
+	e.Movie = &Movie{}
+
+	targets := []any{&e.UserID, &e.MovieID, &e.Position, &e.Watched, &e.WatchedAt, &e.AddedAt}
+
+	return append(targets, e.Movie.scanTargets(movieColumns(nil))...)
+}
+
+// visibleWatchlist selects the entries of the watchlist of user $1 whose movies aren't
+// in the trash, numbering them in order as position. The stored position is kept as
+// stored_position.
+const visibleWatchlist = `
+	SELECT w.user_id, w.movie_id, w.position AS stored_position,
+		row_number() OVER (ORDER BY w.position) AS position,
+		w.watched, w.watched_at, w.added_at
+	FROM watchlist_entries w
+	JOIN movies m ON m.id = w.movie_id
+	WHERE w.user_id = $1 AND m.deleted_at IS NULL`
+
+// watchlistSortExpression qualifies a sort column with the table it belongs to.
+func watchlistSortExpression(column string) string {
+	switch column {
+	case "title":
+		return "m.title"
+	default:
+		return "w." + column
+	}
+}
+
+// GetAllForUser returns a page of the user's watchlist. If watched is not nil, only
+// entries with a matching watched flag are included.
+func (m WatchlistModel) GetAllForUser(userID int64, watched *bool, filters Filters) ([]*WatchlistEntry, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), %s
+		FROM (%s) w
+		JOIN movies m ON m.id = w.movie_id
+		WHERE (w.watched = $2 OR $2 IS NULL)
+		ORDER BY %s %s, w.position ASC
+		LIMIT $3 OFFSET $4`, watchlistColumns(), visibleWatchlist, watchlistSortExpression(filters.sortColumn()), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, watched, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	var totalRecords int
+	entries := []*WatchlistEntry{}
+
+	for rows.Next() {
+		var entry WatchlistEntry
+
+		if err := rows.Scan(append([]any{&totalRecords}, entry.scanTargets()...)...); err != nil {
+			return nil, Metadata{}, err
+		}
+
+		entries = append(entries, &entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Get returns a single entry from the user's watchlist.
+func (m WatchlistModel) Get(userID, movieID int64) (*WatchlistEntry, error) {
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM (%s) w
+		JOIN movies m ON m.id = w.movie_id
+		WHERE w.movie_id = $2`, watchlistColumns(), visibleWatchlist)
+
+	var entry WatchlistEntry
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, movieID).Scan(entry.scanTargets()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &entry, nil
+}
+
+// Insert adds a movie to the end of the user's watchlist. If the movie is already on
+// the watchlist an ErrDuplicateWatchlistEntry error is returned.
+func (m WatchlistModel) Insert(userID, movieID int64) error {
+	query := `
+		INSERT INTO watchlist_entries (user_id, movie_id, position)
+		SELECT $1, $2, COALESCE(MAX(position), 0) + 1
+		FROM watchlist_entries
+		WHERE user_id = $1`
+
+	return m.withWatchlistLock(userID, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query, userID, movieID)
+		if err != nil {
+			switch {
+			case err.Error() == `pq: duplicate key value violates unique constraint "watchlist_entries_pkey"`:
+				return ErrDuplicateWatchlistEntry
+			default:
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Update sets the watched flag of an entry and moves it to entry.Position among the
+// visible entries, shifting the entries in between to keep positions contiguous. A
+// position past the end of the watchlist moves the entry to the end.
+func (m WatchlistModel) Update(entry *WatchlistEntry) error {
+	return m.withWatchlistLock(entry.UserID, func(ctx context.Context, tx *sql.Tx) error {
+		var current, last int
+
+		query := fmt.Sprintf(`
+			SELECT stored_position, (SELECT count(*) FROM (%[1]s) v)
+			FROM (%[1]s) w
+			WHERE movie_id = $2`, visibleWatchlist)
+
+		err := tx.QueryRowContext(ctx, query, entry.UserID, entry.MovieID).Scan(&current, &last)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		position := min(max(entry.Position, 1), last)
+
+		// Moving the entry to the stored position of the visible entry it's taking the
+		// place of also carries along any hidden entries in between, so they keep
+		// their place relative to their neighbours.
+		var target int
+
+		query = fmt.Sprintf(`
+			SELECT stored_position
+			FROM (%s) w
+			WHERE position = $2`, visibleWatchlist)
+
+		if err := tx.QueryRowContext(ctx, query, entry.UserID, position).Scan(&target); err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE watchlist_entries
+			SET position = CASE
+				WHEN movie_id = $2 THEN $4
+				WHEN $4 < $3 THEN position + 1
+				ELSE position - 1
+			END
+			WHERE user_id = $1
+			AND position BETWEEN LEAST($3, $4) AND GREATEST($3, $4)`
+
+		if _, err := tx.ExecContext(ctx, query, entry.UserID, entry.MovieID, current, target); err != nil {
+			return err
+		}
+
+		query = `
+			UPDATE watchlist_entries
+			SET watched = $3,
+				watched_at = CASE
+					WHEN NOT $3 THEN NULL
+					WHEN watched THEN watched_at
+					ELSE NOW()
+				END
+			WHERE user_id = $1 AND movie_id = $2
+			RETURNING watched_at`
+
+		entry.Position = position
+
+		return tx.QueryRowContext(ctx, query, entry.UserID, entry.MovieID, entry.Watched).Scan(&entry.WatchedAt)
+	})
+}
+
+// Delete removes a movie from the user's watchlist and closes the gap it leaves.
+func (m WatchlistModel) Delete(userID, movieID int64) error {
+	return m.withWatchlistLock(userID, func(ctx context.Context, tx *sql.Tx) error {
+		var position int
+
+		query := `
+			DELETE FROM watchlist_entries
+			WHERE user_id = $1 AND movie_id = $2
+			RETURNING position`
+
+		err := tx.QueryRowContext(ctx, query, userID, movieID).Scan(&position)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return ErrRecordNotFound
+			default:
+				return err
+			}
+		}
+
+		query = `
+			UPDATE watchlist_entries
+			SET position = position - 1
+			WHERE user_id = $1 AND position > $2`
+
+		_, err = tx.ExecContext(ctx, query, userID, position)
+		return err
+	})
+}
+
+// withWatchlistLock runs fn in a transaction holding a lock on the user's row, so
+// that concurrent changes to the same watchlist can't hand out the same position.
+func (m WatchlistModel) withWatchlistLock(userID int64, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var id int64
+
+	err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if err := fn(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,132 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrTooManyPixels     = errors.New("image has too many pixels")
+)
+
+// MaxPixels caps the size of the images we're prepared to decode, so that a small
+// but highly compressed upload can't make us allocate gigabytes of memory.
+const MaxPixels = 50_000_000
+
+// ContentTypes maps the image types we accept to the file extension they're saved
+// with.
+var ContentTypes = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// Thumbnail is one of the fixed sizes generated for every uploaded image. The
+// thumbnail fits inside a square of Size pixels, keeping the original aspect ratio.
+type Thumbnail struct {
+	Name string
+	Size int
+}
+
+var Thumbnails = []Thumbnail{
+	{Name: "small", Size: 160},
+	{Name: "medium", Size: 320},
+	{Name: "large", Size: 640},
+}
+
+// Decode sniffs the content type of an image from its first bytes, rather than
+// trusting what the client claims, and decodes it. It returns the detected content
+// type along with the image.
+func Decode(b []byte) (image.Image, string, error) {
+	contentType := http.DetectContentType(b)
+	if _, ok := ContentTypes[contentType]; !ok {
+		return nil, "", ErrUnsupportedFormat
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", ErrUnsupportedFormat
+	}
+
+	if config.Width*config.Height > MaxPixels {
+		return nil, "", ErrTooManyPixels
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, "", ErrUnsupportedFormat
+	}
+
+	return img, contentType, nil
+}
+
+// EncodeThumbnail scales the image down to fit the thumbnail size and encodes it as
+// a JPEG. Images which are already small enough are re-encoded at their own size.
+func EncodeThumbnail(img image.Image, thumbnail Thumbnail) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := fit(bounds.Dx(), bounds.Dy(), thumbnail.Size)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resize(img, width, height), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// fit returns the dimensions of a width x height image scaled down to fit inside a
+// size x size square.
+func fit(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+
+	return max(1, width*size/height), size
+}
+
+// resize scales an image with a box filter: each pixel of the result is the average
+// of the source pixels it covers. That's only suitable for shrinking, which is all we
+// use it for. Transparent areas end up black, as JPEG has no alpha channel.
+func resize(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, max((y+1)*sh/height, y*sh/height+1)
+
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, max((x+1)*sw/width, x*sw/width+1)
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r, g, b, a = r+int(p[0]), g+int(p[1]), b+int(p[2]), a+int(p[3])
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+
+	return dst
+}
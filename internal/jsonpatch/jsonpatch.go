@@ -0,0 +1,438 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902)
+// documents to JSON values.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPatch is returned for a patch document which is malformed, as opposed
+	// to one which is well-formed but can't be applied.
+	ErrInvalidPatch = errors.New("invalid patch document")
+)
+
+// Error describes an operation in a JSON Patch which couldn't be applied, such as one
+// whose path doesn't exist or a test which failed.
+type Error struct {
+	Index int
+	Op    string
+	Path  string
+	Err   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %s", e.Index, e.Op, e.Path, e.Err)
+}
+
+// MergePatch applies a JSON Merge Patch to a document. Members of the patch which are
+// null are removed from the document, objects are merged recursively and everything
+// else replaces the value in the document.
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply applies the operations in a JSON Patch to a document, in order. If any of them
+// fails the whole patch fails, and an *Error says which one.
+func Apply(doc, patch []byte) ([]byte, error) {
+	root, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []operation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("%w: must be an array of operations", ErrInvalidPatch)
+	}
+
+	for i, op := range operations {
+		root, err = op.apply(root)
+		if err != nil {
+			var opErr *Error
+			if errors.As(err, &opErr) {
+				opErr.Index, opErr.Op = i, op.Op
+				if op.Path != nil {
+					opErr.Path = *op.Path
+				}
+			}
+			return nil, err
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+func (op operation) apply(root any) (any, error) {
+	if op.Path == nil {
+		return nil, fmt.Errorf("%w: operation is missing a path", ErrInvalidPatch)
+	}
+
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: %s operation is missing a value", ErrInvalidPatch, op.Op)
+		}
+
+		value, err := decode(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+
+		switch op.Op {
+		case "add":
+			return add(root, path, value)
+		case "replace":
+			return replace(root, path, value)
+		default:
+			current, err := get(root, path)
+			if err != nil {
+				return nil, err
+			}
+			if !equal(current, value) {
+				return nil, &Error{Err: "value does not match"}
+			}
+			return root, nil
+		}
+
+	case "remove":
+		return remove(root, path)
+
+	case "move", "copy":
+		if op.From == nil {
+			return nil, fmt.Errorf("%w: %s operation is missing from", ErrInvalidPatch, op.Op)
+		}
+
+		from, err := parsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := get(root, from)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == "copy" {
+			return add(root, path, deepCopy(value))
+		}
+
+		if len(path) > len(from) && isPrefix(from, path) {
+			return nil, &Error{Err: "cannot move a value into one of its children"}
+		}
+
+		if root, err = remove(root, from); err != nil {
+			return nil, err
+		}
+
+		return add(root, path, value)
+
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+	}
+}
+
+func add(root any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(root, path, func(parent any, key string) (any, error) {
+		switch parent := parent.(type) {
+		case map[string]any:
+			parent[key] = value
+			return parent, nil
+		case []any:
+			if key == "-" {
+				return append(parent, value), nil
+			}
+
+			i, err := arrayIndex(key, len(parent)+1)
+			if err != nil {
+				return nil, err
+			}
+
+			return append(parent[:i], append([]any{value}, parent[i:]...)...), nil
+		default:
+			return nil, &Error{Err: "path does not exist"}
+		}
+	})
+}
+
+func remove(root any, path []string) (any, error) {
+	if len(path) == 0 {
+		return nil, &Error{Err: "cannot remove the whole document"}
+	}
+
+	return update(root, path, func(parent any, key string) (any, error) {
+		switch parent := parent.(type) {
+		case map[string]any:
+			if _, ok := parent[key]; !ok {
+				return nil, &Error{Err: "path does not exist"}
+			}
+			delete(parent, key)
+			return parent, nil
+		case []any:
+			i, err := arrayIndex(key, len(parent))
+			if err != nil {
+				return nil, err
+			}
+			return append(parent[:i], parent[i+1:]...), nil
+		default:
+			return nil, &Error{Err: "path does not exist"}
+		}
+	})
+}
+
+func replace(root any, path []string, value any) (any, error) {
+	if _, err := get(root, path); err != nil {
+		return nil, err
+	}
+
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(root, path, func(parent any, key string) (any, error) {
+		switch parent := parent.(type) {
+		case map[string]any:
+			parent[key] = value
+			return parent, nil
+		case []any:
+			i, err := arrayIndex(key, len(parent))
+			if err != nil {
+				return nil, err
+			}
+			parent[i] = value
+			return parent, nil
+		default:
+			return nil, &Error{Err: "path does not exist"}
+		}
+	})
+}
+
+// update walks down to the parent of the value at path and replaces that parent with
+// the result of calling fn on it and the last token of the path. Arrays can't be
+// changed in place, so each container on the way back up is updated in turn.
+func update(node any, path []string, fn func(parent any, key string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+
+	switch node := node.(type) {
+	case map[string]any:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, &Error{Err: "path does not exist"}
+		}
+
+		child, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+
+		node[path[0]] = child
+		return node, nil
+	case []any:
+		i, err := arrayIndex(path[0], len(node))
+		if err != nil {
+			return nil, err
+		}
+
+		child, err := update(node[i], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+
+		node[i] = child
+		return node, nil
+	default:
+		return nil, &Error{Err: "path does not exist"}
+	}
+}
+
+func get(node any, path []string) (any, error) {
+	for _, key := range path {
+		switch n := node.(type) {
+		case map[string]any:
+			child, ok := n[key]
+			if !ok {
+				return nil, &Error{Err: "path does not exist"}
+			}
+			node = child
+		case []any:
+			i, err := arrayIndex(key, len(n))
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, &Error{Err: "path does not exist"}
+		}
+	}
+
+	return node, nil
+}
+
+// arrayIndex parses an array index from a JSON Pointer token, which must be less than
+// limit. Leading zeros aren't allowed.
+func arrayIndex(key string, limit int) (int, error) {
+	if key == "" || (len(key) > 1 && key[0] == '0') || strings.ContainsFunc(key, func(r rune) bool { return r < '0' || r > '9' }) {
+		return 0, &Error{Err: fmt.Sprintf("%q is not a valid array index", key)}
+	}
+
+	i, err := strconv.Atoi(key)
+	if err != nil || i >= limit {
+		return 0, &Error{Err: "array index out of bounds"}
+	}
+
+	return i, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped tokens. The empty
+// pointer refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: path %q must start with a slash", ErrInvalidPatch, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func decode(b []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func deepCopy(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for key, value := range v {
+			c[key] = deepCopy(value)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, value := range v {
+			c[i] = deepCopy(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// equal compares two decoded JSON values as RFC 6902 describes for the test
+// operation. Numbers are equal if their values are, however they're written.
+func equal(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		return errA == nil && errB == nil && x == y
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,258 @@
+// Package jwt signs and verifies JSON Web Tokens (RFC 7519) in the compact
+// serialization, using either EdDSA with Ed25519 keys or HS256.
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmHS256 = "HS256"
+)
+
+var (
+	// ErrInvalidToken is returned for a token which is malformed, signed with an
+	// unknown key or whose signature doesn't match.
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrInvalidKey   = errors.New("invalid key")
+)
+
+var encoding = base64.RawURLEncoding
+
+// Key is a signing key with the ID it's published under. Ed25519 keys can verify with
+// just their public half, while an HS256 secret does both.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+	secret  []byte
+}
+
+// ParseKey parses a key written as "<id>:<algorithm>:<key>", where the key is base64
+// encoded. For EdDSA it's the 32 byte Ed25519 seed, and for HS256 a secret of at least
+// 32 bytes.
+func ParseKey(spec string) (*Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("%w: must be in the format <id>:<algorithm>:<key>", ErrInvalidKey)
+	}
+
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q is not valid base64", ErrInvalidKey, parts[0])
+	}
+
+	key := &Key{ID: parts[0], Algorithm: parts[1]}
+
+	switch key.Algorithm {
+	case AlgorithmEdDSA:
+		if len(material) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%w: key %q must be a %d byte Ed25519 seed", ErrInvalidKey, key.ID, ed25519.SeedSize)
+		}
+
+		key.private = ed25519.NewKeyFromSeed(material)
+		key.public = key.private.Public().(ed25519.PublicKey)
+	case AlgorithmHS256:
+		if len(material) < 32 {
+			return nil, fmt.Errorf("%w: key %q must be at least 32 bytes long", ErrInvalidKey, key.ID)
+		}
+
+		key.secret = material
+	default:
+		return nil, fmt.Errorf("%w: key %q has unsupported algorithm %q", ErrInvalidKey, key.ID, key.Algorithm)
+	}
+
+	return key, nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == AlgorithmEdDSA {
+		return ed25519.Sign(k.private, input)
+	}
+
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == AlgorithmEdDSA {
+		return ed25519.Verify(k.public, input, signature)
+	}
+
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// KeySet signs tokens with its first key and accepts tokens signed with any of them,
+// so that a key can be rotated out by moving a new one in front of it and dropping it
+// once the tokens it signed have expired.
+type KeySet struct {
+	keys []*Key
+}
+
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: at least one key is required", ErrInvalidKey)
+	}
+
+	seen := make(map[string]bool, len(keys))
+
+	for _, key := range keys {
+		if seen[key.ID] {
+			return nil, fmt.Errorf("%w: duplicate key id %q", ErrInvalidKey, key.ID)
+		}
+
+		seen[key.ID] = true
+	}
+
+	return &KeySet{keys: keys}, nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Sign encodes the claims as a token signed with the current key. The claims should
+// include an "exp" member, since Verify rejects tokens without one.
+func (ks *KeySet) Sign(claims any) (string, error) {
+	key := ks.keys[0]
+
+	h, err := json.Marshal(header{Algorithm: key.Algorithm, KeyID: key.ID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+
+	return input + "." + encoding.EncodeToString(key.sign([]byte(input))), nil
+}
+
+// Verify checks the token's signature and expiry, then decodes its claims into the
+// value pointed to by claims.
+func (ks *KeySet) Verify(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return ErrInvalidToken
+	}
+
+	key := ks.key(h.KeyID)
+
+	// The algorithm must be the key's own, or a token could pick a weaker one.
+	if key == nil || h.Algorithm != key.Algorithm {
+		return ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidToken
+	}
+
+	var registered struct {
+		Expiry    *int64 `json:"exp"`
+		NotBefore *int64 `json:"nbf"`
+	}
+
+	if err := decodeSegment(parts[1], &registered); err != nil {
+		return ErrInvalidToken
+	}
+
+	now := time.Now().Unix()
+
+	if registered.Expiry == nil || now >= *registered.Expiry {
+		return ErrExpiredToken
+	}
+
+	if registered.NotBefore != nil && now < *registered.NotBefore {
+		return ErrInvalidToken
+	}
+
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func (ks *KeySet) key(id string) *Key {
+	for _, key := range ks.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := encoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// JWK is the public half of a key, as published in a JSON Web Key Set (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the set's public keys. HS256 secrets can't be published, so a set of
+// only HS256 keys gives an empty key set.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	for _, key := range ks.keys {
+		if key.Algorithm != AlgorithmEdDSA {
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         encoding.EncodeToString(key.public),
+			KeyID:     key.ID,
+			Algorithm: key.Algorithm,
+			Use:       "sig",
+		})
+	}
+
+	return jwks
+}
@@ -0,0 +1,301 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Subject   string `json:"sub"`
+	Expiry    *int64 `json:"exp,omitempty"`
+	NotBefore *int64 `json:"nbf,omitempty"`
+}
+
+func mustParseKey(t *testing.T, id, algorithm string, fill byte) *Key {
+	t.Helper()
+
+	material := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+
+	key, err := ParseKey(id + ":" + algorithm + ":" + material)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func mustNewKeySet(t *testing.T, keys ...*Key) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ks
+}
+
+// signWith builds a token with an arbitrary header, signed with the given key, so that
+// tokens Sign would never produce can be checked.
+func signWith(t *testing.T, key *Key, h header, claims any) string {
+	t.Helper()
+
+	hb, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := encoding.EncodeToString(hb) + "." + encoding.EncodeToString(payload)
+
+	return input + "." + encoding.EncodeToString(key.sign([]byte(input)))
+}
+
+func unix(d time.Duration) *int64 {
+	n := time.Now().Add(d).Unix()
+	return &n
+}
+
+func TestVerify(t *testing.T) {
+	ed := mustParseKey(t, "ed", AlgorithmEdDSA, 1)
+	hs := mustParseKey(t, "hs", AlgorithmHS256, 2)
+	other := mustParseKey(t, "other", AlgorithmHS256, 3)
+
+	ks := mustNewKeySet(t, ed, hs)
+
+	valid := testClaims{Subject: "1", Expiry: unix(time.Hour)}
+
+	tests := []struct {
+		name  string
+		token func() string
+		err   error
+	}{
+		{
+			name: "valid EdDSA",
+			token: func() string {
+				return signWith(t, ed, header{Algorithm: AlgorithmEdDSA, KeyID: "ed"}, valid)
+			},
+		},
+		{
+			name: "valid HS256",
+			token: func() string {
+				return signWith(t, hs, header{Algorithm: AlgorithmHS256, KeyID: "hs"}, valid)
+			},
+		},
+		{
+			name: "algorithm doesn't match the key",
+			token: func() string {
+				return signWith(t, hs, header{Algorithm: AlgorithmEdDSA, KeyID: "hs"}, valid)
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "key ID of a key with another algorithm",
+			token: func() string {
+				return signWith(t, hs, header{Algorithm: AlgorithmHS256, KeyID: "ed"}, valid)
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "none algorithm",
+			token: func() string {
+				token := signWith(t, ed, header{Algorithm: "none", KeyID: "ed"}, valid)
+				return token[:strings.LastIndex(token, ".")+1]
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "unknown key ID",
+			token: func() string {
+				return signWith(t, other, header{Algorithm: AlgorithmHS256, KeyID: "other"}, valid)
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "signed with another key under a known ID",
+			token: func() string {
+				return signWith(t, other, header{Algorithm: AlgorithmHS256, KeyID: "hs"}, valid)
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "tampered payload",
+			token: func() string {
+				parts := strings.Split(signWith(t, ed, header{Algorithm: AlgorithmEdDSA, KeyID: "ed"}, valid), ".")
+
+				payload, _ := json.Marshal(testClaims{Subject: "2", Expiry: valid.Expiry})
+				parts[1] = encoding.EncodeToString(payload)
+
+				return strings.Join(parts, ".")
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "tampered signature",
+			token: func() string {
+				token := signWith(t, hs, header{Algorithm: AlgorithmHS256, KeyID: "hs"}, valid)
+				return token[:len(token)-2] + "AA"
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name:  "malformed",
+			token: func() string { return "not.a-token" },
+			err:   ErrInvalidToken,
+		},
+		{
+			name: "missing exp",
+			token: func() string {
+				return signWith(t, ed, header{Algorithm: AlgorithmEdDSA, KeyID: "ed"}, testClaims{Subject: "1"})
+			},
+			err: ErrExpiredToken,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := testClaims{Subject: "1", Expiry: unix(-time.Minute)}
+				return signWith(t, ed, header{Algorithm: AlgorithmEdDSA, KeyID: "ed"}, claims)
+			},
+			err: ErrExpiredToken,
+		},
+		{
+			name: "not yet valid",
+			token: func() string {
+				claims := testClaims{Subject: "1", Expiry: unix(time.Hour), NotBefore: unix(time.Minute)}
+				return signWith(t, ed, header{Algorithm: AlgorithmEdDSA, KeyID: "ed"}, claims)
+			},
+			err: ErrInvalidToken,
+		},
+		{
+			name: "nbf in the past",
+			token: func() string {
+				claims := testClaims{Subject: "1", Expiry: unix(time.Hour), NotBefore: unix(-time.Minute)}
+				return signWith(t, ed, header{Algorithm: AlgorithmEdDSA, KeyID: "ed"}, claims)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims testClaims
+
+			err := ks.Verify(tt.token(), &claims)
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("got error %v; want %v", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if claims.Subject != valid.Subject {
+				t.Errorf("got subject %q; want %q", claims.Subject, valid.Subject)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	current := mustParseKey(t, "2024", AlgorithmEdDSA, 1)
+	next := mustParseKey(t, "2025", AlgorithmEdDSA, 2)
+
+	claims := testClaims{Subject: "1", Expiry: unix(time.Hour)}
+
+	old, err := mustNewKeySet(t, current).Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ks   *KeySet
+		err  error
+	}{
+		{"signing key", mustNewKeySet(t, current), nil},
+		{"new key moved in front", mustNewKeySet(t, next, current), nil},
+		{"old key dropped", mustNewKeySet(t, next), ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got testClaims
+
+			if err := tt.ks.Verify(old, &got); !errors.Is(err, tt.err) {
+				t.Errorf("got error %v; want %v", err, tt.err)
+			}
+		})
+	}
+
+	// Tokens are signed with the first key once it's moved in front.
+	token, err := mustNewKeySet(t, next, current).Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got testClaims
+
+	if err := mustNewKeySet(t, next).Verify(token, &got); err != nil {
+		t.Errorf("token signed after rotation: unexpected error: %v", err)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	seed := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name string
+		spec string
+		err  bool
+	}{
+		{"EdDSA", "a:EdDSA:" + seed, false},
+		{"HS256", "a:HS256:" + seed, false},
+		{"missing parts", "a:EdDSA", true},
+		{"missing ID", ":EdDSA:" + seed, true},
+		{"invalid base64", "a:EdDSA:!!!", true},
+		{"short Ed25519 seed", "a:EdDSA:" + short, true},
+		{"short HS256 secret", "a:HS256:" + short, true},
+		{"unsupported algorithm", "a:RS256:" + seed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKey(tt.spec)
+
+			if tt.err && !errors.Is(err, ErrInvalidKey) {
+				t.Errorf("got error %v; want ErrInvalidKey", err)
+			}
+
+			if !tt.err && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	ks := mustNewKeySet(t, mustParseKey(t, "ed", AlgorithmEdDSA, 1), mustParseKey(t, "hs", AlgorithmHS256, 2))
+
+	jwks := ks.JWKS()
+
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("got %d keys; want 1", len(jwks.Keys))
+	}
+
+	if jwks.Keys[0].KeyID != "ed" || jwks.Keys[0].Curve != "Ed25519" {
+		t.Errorf("got %+v; want the Ed25519 key", jwks.Keys[0])
+	}
+}
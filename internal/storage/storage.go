@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidKey = errors.New("invalid storage key")
+)
+
+// Storage saves uploaded files under a slash-separated key, such as
+// "movies/1/images/2/original.jpg", and knows the public URL each one is served from.
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	Delete(ctx context.Context, key string) error
+	URL(key string) string
+}
+
+// Local keeps files in a directory on the local filesystem. The API serves them itself,
+// from the path given as the base URL.
+type Local struct {
+	root    string
+	baseURL string
+}
+
+func NewLocal(root, baseURL string) (*Local, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Local{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// Root returns the directory the files are kept in.
+func (l *Local) Root() string {
+	return l.root
+}
+
+// ServePath returns the path the API should serve the files from, taken from the base
+// URL. A base URL with a host points somewhere else, such as a CDN in front of the
+// directory, in which case ok is false and the API doesn't serve them.
+func (l *Local) ServePath() (string, bool) {
+	u, err := url.Parse(l.baseURL)
+	if err != nil || u.Host != "" || !strings.HasPrefix(u.Path, "/") || u.Path == "/" {
+		return "", false
+	}
+
+	return u.Path, true
+}
+
+// Put writes the file to a temporary name first and renames it into place once it's
+// complete, so that a half-written file is never served.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+// Delete removes a file. Deleting a file which doesn't exist isn't an error.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) URL(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	return l.baseURL + "/" + strings.Join(segments, "/")
+}
+
+// path maps a key to a file under the root directory, refusing any key which would
+// escape it.
+func (l *Local) path(key string) (string, error) {
+	if key == "" || path.Clean(key) != key || !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
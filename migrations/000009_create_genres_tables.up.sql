@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text NOT NULL
+);
+
+-- Every spelling that resolves to a genre, including its own name, is stored here in
+-- lower case. The primary key stops the same spelling pointing at two genres.
+CREATE TABLE IF NOT EXISTS genre_aliases (
+    alias text PRIMARY KEY,
+    genre_id bigint NOT NULL REFERENCES genres ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS genre_aliases_genre_id_idx ON genre_aliases (genre_id);
+
+-- Seed the genres from the ones already used by movies, keeping the first spelling
+-- of each case-insensitive variant as the canonical name.
+INSERT INTO genres (name)
+SELECT DISTINCT ON (lower(genre)) genre
+FROM movies, unnest(movies.genres) AS genre
+ORDER BY lower(genre), genre;
+
+INSERT INTO genre_aliases (alias, genre_id)
+SELECT lower(name), id FROM genres
+ON CONFLICT DO NOTHING;
+
+-- Rewrite existing movies to use the canonical spellings, dropping any duplicates
+-- that this creates while keeping the original order. Like a rename or merge, every
+-- movie this changes gets a new version, which is recorded in its revision history.
+WITH canonical AS (
+    SELECT movies.id, ARRAY(
+        SELECT genres.name
+        FROM unnest(movies.genres) WITH ORDINALITY AS input(name, position)
+        INNER JOIN genre_aliases ON genre_aliases.alias = lower(input.name)
+        INNER JOIN genres ON genres.id = genre_aliases.genre_id
+        GROUP BY genres.name
+        ORDER BY min(input.position)
+    ) AS genres
+    FROM movies
+),
+updated AS (
+    UPDATE movies
+    SET genres = canonical.genres, version = movies.version + 1
+    FROM canonical
+    WHERE canonical.id = movies.id AND canonical.genres IS DISTINCT FROM movies.genres
+    RETURNING movies.id, movies.version, movies.title, movies.year, movies.runtime, movies.genres
+)
+INSERT INTO movie_revisions (movie_id, version, title, year, runtime, genres)
+SELECT id, version, title, year, runtime, genres FROM updated;
@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS tokens_record_revoked ON tokens;
+DROP FUNCTION IF EXISTS record_revoked_token();
+DROP TABLE IF EXISTS revoked_tokens;
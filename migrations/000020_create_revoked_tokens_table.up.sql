@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    hash bytea PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL,
+    revoked_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_revoked_at_idx ON revoked_tokens (revoked_at);
+
+-- Signed authentication tokens are checked without a trip to the database, so every
+-- unexpired authentication token which is deleted, however that happens, is recorded
+-- here for the API to pick up.
+CREATE OR REPLACE FUNCTION record_revoked_token() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO revoked_tokens (hash, expiry) VALUES (OLD.hash, OLD.expiry) ON CONFLICT DO NOTHING;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tokens_record_revoked
+AFTER DELETE ON tokens
+FOR EACH ROW WHEN (OLD.scope = 'authentication' AND OLD.expiry > NOW())
+EXECUTE FUNCTION record_revoked_token();